@@ -0,0 +1,69 @@
+import { HttpErrorResponse, HttpEvent, HttpHandler, HttpInterceptor, HttpRequest, HttpResponse } from '@angular/common/http';
+import { Injectable } from '@angular/core';
+import { Observable, throwError } from 'rxjs';
+import { catchError, filter, finalize, map, shareReplay, switchMap } from 'rxjs/operators';
+
+/**
+ * Add the access token to every api request
+ * If it is rejected the tokens are refreshed once and the request is sent again, the session is cleared if it fails
+ */
+@Injectable()
+export class AuthInterceptor implements HttpInterceptor {
+
+  /**
+   * Refresh in progress, it is shared by the requests rejected meanwhile since a refresh token can only be exchanged once
+   */
+  private refreshing?: Observable<void>;
+
+  public intercept(req: HttpRequest<unknown>, next: HttpHandler): Observable<HttpEvent<unknown>> {
+    const token = localStorage.getItem('token');
+    if (!token || !req.url.includes('/api/') || req.url.endsWith('/api/auth') || req.url.endsWith('/api/auth/refresh'))
+      return next.handle(req);
+    return next.handle(this.withToken(req)).pipe(catchError((e: HttpErrorResponse) => {
+      if (e.status !== 401)
+        return throwError(e);
+      if (!localStorage.getItem('refreshToken'))
+        return this.clearSession(e);
+      return this.refresh(req, next).pipe(
+        catchError(() => this.clearSession(e)),
+        switchMap(() => next.handle(this.withToken(req))),
+        catchError((retryError: HttpErrorResponse) => retryError.status === 401 ? this.clearSession(retryError) : throwError(retryError)),
+      );
+    }));
+  }
+
+  private withToken(req: HttpRequest<unknown>) {
+    return req.clone({ setHeaders: { Authorization: `Bearer ${localStorage.getItem('token')}` } });
+  }
+
+  /**
+   * Exchange the refresh token for a new pair of tokens, the refresh route is next to the route of the rejected request
+   */
+  private refresh(req: HttpRequest<unknown>, next: HttpHandler): Observable<void> {
+    if (!this.refreshing) {
+      const url = req.url.slice(0, req.url.indexOf('/api/')) + '/api/auth/refresh';
+      this.refreshing = next.handle(new HttpRequest('POST', url, { refreshToken: localStorage.getItem('refreshToken') })).pipe(
+        filter((event): event is HttpResponse<TokenPair> => event instanceof HttpResponse),
+        map(res => {
+          localStorage.setItem('token', res.body!.token);
+          localStorage.setItem('refreshToken', res.body!.refreshToken);
+        }),
+        finalize(() => this.refreshing = undefined),
+        shareReplay(1),
+      );
+    }
+    return this.refreshing;
+  }
+
+  private clearSession(e: HttpErrorResponse) {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    return throwError(e);
+  }
+}
+
+type TokenPair = {
+  token: string;
+  refreshToken: string;
+  expiresAt: number;
+}
@@ -1,5 +1,5 @@
 import { HttpClient, HttpErrorResponse } from '@angular/common/http';
-import { Component } from '@angular/core';
+import { Component, OnInit } from '@angular/core';
 import {MatSnackBar} from '@angular/material/snack-bar';
 import { environment } from 'src/environments/environment';
 
@@ -8,22 +8,49 @@ import { environment } from 'src/environments/environment';
   templateUrl: './auth.component.html',
   styleUrls: ['./auth.component.scss']
 })
-export class AuthComponent {
+export class AuthComponent implements OnInit {
 
+  public username?: string;
   public password?: string;
+  public oidc = false;
 
   constructor(
     private readonly http: HttpClient,
     private readonly snackbar: MatSnackBar,
   ) { }
 
+  public async ngOnInit() {
+    //The SSO callback gives the tokens or the error in the url fragment
+    const params = new URLSearchParams(location.hash.slice(1));
+    if (params.has('token') || params.has('error')) {
+      history.replaceState(null, '', location.pathname + location.search);
+      if (params.get('token')) {
+        localStorage.setItem('token', params.get('token')!);
+        localStorage.setItem('refreshToken', params.get('refreshToken') || '');
+        this.snackbar.open('Login successful');
+      } else
+        this.snackbar.open(params.get('error') || 'Error while authenticating', '', { duration: 2000 });
+    }
+    try {
+      const providers = await this.http.get<ProvidersRes>(this.apiUrl('/api/auth/providers')).toPromise();
+      this.oidc = providers.oidc;
+    } catch (e) {
+      console.error(e);
+    }
+  }
+
+  public loginWithSSO() {
+    location.href = this.apiUrl('/api/auth/oidc');
+  }
+
   public async submit(e: Event) {
     e.preventDefault();
     if (this.password) {
       try {
-        const { token } = await this.http.post<AuthRes>(environment.production ? '/api/auth' : 'http://localhost:8081/api/auth', { password: this.password }).toPromise();
+        const { token, refreshToken } = await this.http.post<AuthRes>(this.apiUrl('/api/auth'), { username: this.username, password: this.password }).toPromise();
         if (token) {
           localStorage.setItem('token', token);
+          localStorage.setItem('refreshToken', refreshToken);
           this.snackbar.open('Login successful');
         } else {
           this.snackbar.open('Error while authenticating', '', { duration: 2000 });
@@ -31,7 +58,7 @@ export class AuthComponent {
       } catch (e) {
         if (e instanceof HttpErrorResponse) {
           if (e.status === 401) {
-            this.snackbar.open("Bad password", "", { duration: 2000 });
+            this.snackbar.open("Bad username or password", "", { duration: 2000 });
           } else 
             this.snackbar.open('Error while authenticating', '', { duration: 2000 });
         } else
@@ -41,8 +68,18 @@ export class AuthComponent {
     }
   }
 
+  private apiUrl(path: string) {
+    return environment.production ? path : 'http://localhost:8081' + path;
+  }
+
 }
 
 type AuthRes = {
   token: string;
+  refreshToken: string;
+  expiresAt: number;
+}
+type ProvidersRes = {
+  password: boolean;
+  oidc: boolean;
 }
\ No newline at end of file
@@ -1,7 +1,7 @@
 import { MatSnackBar } from '@angular/material/snack-bar';
 import { HttpClient, HttpErrorResponse } from '@angular/common/http';
 import { Container } from '@angular/compiler/src/i18n/i18n_ast';
-import { Component, OnInit } from '@angular/core';
+import { Component, OnDestroy, OnInit } from '@angular/core';
 import { environment } from 'src/environments/environment';
 
 @Component({
@@ -9,9 +9,13 @@ import { environment } from 'src/environments/environment';
   templateUrl: './board.component.html',
   styleUrls: ['./board.component.scss']
 })
-export class BoardComponent implements OnInit {
+export class BoardComponent implements OnInit, OnDestroy {
 
   public containerData: ContainerInfo[] = [];
+  public linkedJob?: JobRecord;
+
+  private socket?: WebSocket;
+  private destroyed = false;
 
   constructor(
     private readonly http: HttpClient,
@@ -21,12 +25,78 @@ export class BoardComponent implements OnInit {
   public async ngOnInit() {
     try {
       this.containerData = await this.http.get<ContainerInfo[]>(environment.production ? '/api/' : 'http://localhost:8081/api/').toPromise();
+      this.connect();
+      await this.loadLinkedJob();
     } catch (e) {
       console.error(e);
       localStorage.removeItem('token');
     }
   }
 
+  /**
+   * Show the job given in the url fragment (#job=<id>), it is the link posted to the commit statuses
+   */
+  private async loadLinkedJob() {
+    const id = new URLSearchParams(location.hash.slice(1)).get('job');
+    if (!id)
+      return;
+    try {
+      this.linkedJob = await this.http.get<JobRecord>(environment.production ? `/api/jobs/${id}` : `http://localhost:8081/api/jobs/${id}`).toPromise();
+    } catch (e) {
+      this.snackbar.open('Job not found, only the last jobs are kept', 'Close', { duration: 5000 });
+    }
+  }
+
+  public ngOnDestroy() {
+    this.destroyed = true;
+    this.socket?.close();
+  }
+
+  /**
+   * Listen to the live event feed, reconnect if the connection is lost
+   */
+  private connect() {
+    const base = environment.production ? `${location.protocol === 'https:' ? 'wss' : 'ws'}://${location.host}` : 'ws://localhost:8081';
+    this.socket = new WebSocket(`${base}/api/events?access_token=${localStorage.getItem('token')}`);
+    this.socket.onmessage = (msg) => this.onEvent(JSON.parse(msg.data));
+    this.socket.onclose = () => !this.destroyed && setTimeout(() => this.reconnect(), 5000);
+  }
+
+  /**
+   * Reload the containers before reconnecting, the events missed meanwhile are lost
+   * The stream is closed when the access token expires, the reload refreshes it
+   */
+  private async reconnect() {
+    try {
+      this.containerData = await this.http.get<ContainerInfo[]>(environment.production ? '/api/' : 'http://localhost:8081/api/').toPromise();
+    } catch (e) {
+      console.error(e);
+    }
+    if (!this.destroyed && localStorage.getItem('token'))
+      this.connect();
+  }
+
+  private onEvent(event: BusEvent) {
+    const index = this.containerData.findIndex(el => el.Id === event.containerId);
+    const container = this.containerData[index];
+    if (event.kind === 'registry') {
+      if (event.type === 'removed' && index !== -1)
+        this.containerData.splice(index, 1);
+      else if (event.type === 'added' && index === -1)
+        this.containerData.push(event.data);
+      else if (event.type === 'updated' && container)
+        this.containerData[index] = { ...event.data, isUpdating: container.isUpdating, job: container.job, logs: container.logs };
+    } else if (event.kind === 'job' && container) {
+      if (event.type === 'job.started')
+        container.logs = [];
+      container.job = event.job;
+      const progress = event.data;
+      if (event.type === 'job.progress' && progress && typeof progress.data === 'string') {
+        container.logs = [...(container.logs || []), progress.data].slice(-200);
+      }
+    }
+  }
+
   public normalizeContainerNames(name: string) {
     return name.replace(/\//g, '');
   }
@@ -34,7 +104,7 @@ export class BoardComponent implements OnInit {
   public async update(el: ContainerInfo) {
     el.isUpdating = true;
     try {
-      await this.http.get(environment.production ? '/hooks' + el.Names[0] : 'http://localhost:8081/hooks' + el.Names[0]).toPromise();
+      await this.http.post(environment.production ? `/api/containers/${el.Hook}/deploy` : `http://localhost:8081/api/containers/${el.Hook}/deploy`, {}).toPromise();
     } catch (e) {
       if ((e as HttpErrorResponse).status < 300)
         return;
@@ -49,5 +119,55 @@ export class BoardComponent implements OnInit {
 type ContainerInfo = {
   Names: string[];
   Id: string;
+  Hook: string;
+  Aliases: string[];
+  Error?: string;
+  State: ContainerState;
   isUpdating: boolean;
+  job?: Job;
+  logs?: string[];
+}
+
+type ContainerState = {
+  Status: string;
+  Running: boolean;
+  ExitCode: number;
+  Health?: string;
+  RestartCount: number;
+}
+
+type Job = {
+  id: string;
+  container: string;
+  trigger: string;
+  repository?: string;
+  commit?: string;
+  status: string;
+  startedAt: string;
+  endedAt: string;
+  error?: string;
+  timeline?: Timeline;
+}
+
+type Timeline = {
+  phases: { name: string; startedAt: string; endedAt: string; durationMs: number; error?: string }[];
+  bytesPulled: number;
+  layersDownloaded: number;
+  layersCached: number;
+  buildSteps: number;
+}
+
+type JobRecord = {
+  job: Job;
+  logs: string[];
+}
+
+type BusEvent = {
+  kind: 'registry' | 'job' | 'connection';
+  type: string;
+  containerId?: string;
+  container?: string;
+  time: string;
+  job?: Job;
+  data?: any;
 }
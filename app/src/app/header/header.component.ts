@@ -1,4 +1,6 @@
-import { Component, OnInit } from '@angular/core';
+import { HttpClient } from '@angular/common/http';
+import { Component } from '@angular/core';
+import { environment } from 'src/environments/environment';
 
 @Component({
   selector: 'app-header',
@@ -9,8 +11,19 @@ export class HeaderComponent {
 
   public get logged() { return localStorage.getItem('token') !== null; }
   
-  public logout() {
+  constructor(
+    private readonly http: HttpClient,
+  ) { }
+
+  public async logout() {
+    const refreshToken = localStorage.getItem('refreshToken');
+    try {
+      await this.http.post(environment.production ? '/api/auth/logout' : 'http://localhost:8081/api/auth/logout', { refreshToken }).toPromise();
+    } catch (e) {
+      console.error(e);
+    }
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
   }
 
 }
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"dockerci/src/audit"
+	"dockerci/src/users"
+	"dockerci/src/utils"
+)
+
+//Headers carrying the delivery id of a webhook for each provider
+var deliveryHeaders = []string{"X-GitHub-Delivery", "X-Gitea-Delivery", "X-Gogs-Delivery", "X-Gitlab-Event-UUID"}
+
+//Append an entry to the audit log with the source ip of the request
+//The actor is taken from the authenticated request if it is not set
+func (s *Server) record(req *http.Request, entry audit.Entry) {
+	entry.SourceIP = s.clientIP(req)
+	if entry.Actor == "" {
+		entry.Actor, entry.Key = actorOf(getPrincipal(req))
+	}
+	if err := s.audit.Record(entry); err != nil {
+		apiLog.With("action", entry.Action).Errorf("Error while writing audit log: %v", err)
+	}
+}
+
+//Get the username and the api key id of a principal
+func actorOf(principal users.Principal) (string, string) {
+	switch principal := principal.(type) {
+	case *users.User:
+		return principal.Username, ""
+	case *users.KeyPrincipal:
+		return principal.Owner.Username, principal.Key.Id
+	}
+	return "", ""
+}
+
+//Get the outcome of a request from its status code
+func outcomeOf(status int) audit.Outcome {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return audit.Denied
+	case status >= 400:
+		return audit.Failure
+	}
+	return audit.Success
+}
+
+//Get the provider delivery id of a webhook
+func deliveryId(req *http.Request) string {
+	for _, header := range deliveryHeaders {
+		if id := req.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+//Get the audit entries matching the query filters, the most recent first
+func (s *Server) fetchAudit(res http.ResponseWriter, req *http.Request) {
+	query, err := parseAuditQuery(req)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	if query.Limit == 0 {
+		query.Limit = 100
+	}
+	entries, err := s.audit.Query(query)
+	if err != nil {
+		apiLog.Errorf("Error while reading audit log: %v", err)
+		res.WriteHeader(500)
+		res.Write(utils.ToJSON(map[string]string{"error": "Internal server error"}))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(entries))
+}
+
+//Export the audit entries matching the query filters as JSON Lines
+func (s *Server) exportAudit(res http.ResponseWriter, req *http.Request) {
+	query, err := parseAuditQuery(req)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.Header().Set("Content-Disposition", "attachment; filename=audit.jsonl")
+	res.WriteHeader(200)
+	if err := s.audit.Export(res, query); err != nil {
+		apiLog.Errorf("Error while exporting audit log: %v", err)
+	}
+}
+
+//Parse the filters of an audit request (action, actor, target, outcome, since, until, limit)
+func parseAuditQuery(req *http.Request) (audit.Query, error) {
+	values := req.URL.Query()
+	query := audit.Query{
+		Action:  values.Get("action"),
+		Actor:   values.Get("actor"),
+		Target:  values.Get("target"),
+		Outcome: audit.Outcome(values.Get("outcome")),
+	}
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return query, err
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return query, err
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
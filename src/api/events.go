@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"dockerci/src/api/middleware"
+	"dockerci/src/docker"
+	"dockerci/src/users"
+
+	"github.com/gorilla/websocket"
+)
+
+var eventsUpgrader = websocket.Upgrader{CheckOrigin: checkEventsOrigin}
+
+var eventsPingInterval = 30 * time.Second //The tokens are checked again on each ping
+
+//Stream the registry changes, the job progress and the docker connection changes over a websocket
+//Events can be filtered on a container with the container query param
+func (s *Server) streamEvents(res http.ResponseWriter, req *http.Request) {
+	principal := getPrincipal(req)
+	c, err := eventsUpgrader.Upgrade(res, req, nil)
+	if err != nil {
+		apiLog.Warnf("Error while opening the event stream: %v", err)
+		return
+	}
+	defer c.Close()
+	filter := docker.Filter{Kinds: []docker.EventKind{docker.RegistryEventKind, docker.JobEventKind, docker.ConnectionEventKind}}
+	if container := req.URL.Query().Get("container"); container != "" {
+		filter.Containers = []string{container}
+	}
+	sub := s.docker.Bus.Subscribe("websocket "+req.RemoteAddr, 256, filter)
+	defer sub.Close()
+	//Messages from the client are discarded, reading is only used to detect the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	//The stream ends with the access token, api keys are checked again on each ping
+	var expired <-chan time.Time
+	if claims := middleware.GetClaims(req); claims != nil {
+		timer := time.NewTimer(time.Until(time.Unix(claims.ExpiresAt, 0)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ticker := time.NewTicker(eventsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-sub.C:
+			if !s.canReadEvent(principal, event) {
+				continue
+			}
+			c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			//The token may have been revoked and the user deleted or changed since the upgrade
+			var ok bool
+			if principal, ok = s.reauthenticate(req); !ok {
+				closeUnauthorized(c)
+				return
+			}
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-expired:
+			closeUnauthorized(c)
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+//Authenticate the request of an event stream again with the token given at the upgrade
+func (s *Server) reauthenticate(req *http.Request) (users.Principal, bool) {
+	token, _ := middleware.BearerToken(req)
+	if users.IsKeyToken(token) {
+		principal, ok := s.authenticateKey(token)
+		if !ok {
+			return nil, false
+		}
+		return principal, true
+	}
+	claims, err := middleware.Authenticate(req)
+	if err != nil {
+		return nil, false
+	}
+	user, ok := s.users.Get(claims.Username)
+	if !ok {
+		return nil, false
+	}
+	return &user, true
+}
+
+//Close an event stream whose token is not valid anymore
+func closeUnauthorized(c *websocket.Conn) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Unauthorized"), time.Now().Add(time.Second))
+}
+
+//Only accept the websocket from the dashboard served at BASE_URL, it is the same origin check as the upgrader if it is not set
+//Clients other than browsers don't send an origin and are accepted
+func checkEventsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	base, err := url.Parse(os.Getenv("BASE_URL"))
+	if err != nil || base.Host == "" {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	return strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+}
+
+//Check if the user can read the container concerned by an event
+func (s *Server) canReadEvent(principal users.Principal, event docker.Event) bool {
+	if user, ok := principal.(*users.User); event.ContainerId == "" || (ok && user.Role == users.RoleAdmin) {
+		return true
+	}
+	//Removed containers are not in the registry anymore, the event carries them
+	container, ok := event.Data.(docker.ContainerInfo)
+	if !ok {
+		if container, ok = s.containers.GetById(event.ContainerId); !ok {
+			return false
+		}
+	}
+	return principal.Can(users.ActionRead, &container)
+}
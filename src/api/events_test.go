@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dockerci/src/api/middleware"
+	"dockerci/src/docker"
+
+	"github.com/gorilla/websocket"
+)
+
+//Open an event stream with a token, the server checks the tokens every 20ms
+func openEvents(t *testing.T, server *Server, token string) *websocket.Conn {
+	interval := eventsPingInterval
+	eventsPingInterval = 20 * time.Millisecond
+	t.Cleanup(func() { eventsPingInterval = interval })
+	ts := httptest.NewServer(middleware.WebsocketToken(server.authMiddleware(http.HandlerFunc(server.streamEvents))))
+	t.Cleanup(ts.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/events?access_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+//Wait for the stream to be closed as unauthorized, the published events are skipped
+func expectUnauthorized(t *testing.T, c *websocket.Conn) {
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("got %v, want the stream closed as unauthorized", err)
+			}
+			return
+		}
+	}
+}
+
+func TestEventStreamEndsWithItsToken(t *testing.T) {
+	t.Setenv("PRIVATE_KEY", "0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		ttl    string
+		key    bool
+		revoke func(server *Server, token string)
+	}{
+		{"expired access token", "1s", false, nil},
+		{"revoked access token", "", false, func(server *Server, token string) {
+			claims, _ := middleware.VerifyToken(token, middleware.AccessToken)
+			middleware.Revoke(claims)
+		}},
+		{"deleted user", "", false, func(server *Server, token string) {
+			server.users.Delete("admin")
+		}},
+		{"revoked api key", "", true, func(server *Server, token string) {
+			for _, key := range server.keys.List("admin") {
+				server.keys.Revoke(key.Id)
+			}
+		}},
+		{"deleted owner of the api key", "", true, func(server *Server, token string) {
+			server.users.Delete("admin")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ACCESS_TOKEN_TTL", test.ttl)
+			server, _, readKey, _ := newHookServer(t)
+			server.docker = &docker.DockerClient{Bus: docker.NewBus()}
+			token := readKey
+			if !test.key {
+				tokens, err := middleware.IssueTokens("admin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				token = tokens.Token
+			}
+			c := openEvents(t, server, token)
+			//The stream stays open while the token is valid
+			server.docker.Bus.Publish(docker.Event{Kind: docker.ConnectionEventKind, Type: "connected"})
+			c.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, _, err := c.ReadMessage(); err != nil {
+				t.Fatalf("no event received: %v", err)
+			}
+			if test.revoke != nil {
+				test.revoke(server, token)
+			}
+			expectUnauthorized(t, c)
+		})
+	}
+}
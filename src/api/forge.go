@@ -0,0 +1,116 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"dockerci/src/audit"
+	"dockerci/src/docker"
+	"dockerci/src/forge"
+	"dockerci/src/users"
+	"dockerci/src/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type ForgeRequest struct {
+	forge.Repository
+	Token string `json:"token"` //Kept if empty when the repository already exists
+}
+
+//Get the forge repositories to which the deploy statuses are reported, the tokens are never sent
+func (s *Server) fetchForgeRepositories(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(s.forge.List()))
+}
+
+//Add or update a forge repository and its token
+func (s *Server) setForgeRepository(res http.ResponseWriter, req *http.Request) {
+	var data ForgeRequest
+	if err := utils.FromJSON(req.Body, &data); err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	repository, err := s.forge.Set(data.Repository, data.Token)
+	entry := audit.Entry{Action: audit.ActionForgeSet, Target: docker.RepositoryName(data.Name), Outcome: audit.Success, Details: map[string]string{"type": repository.Type, "apiUrl": repository.ApiUrl}}
+	if data.Token != "" {
+		entry.Details["token"] = "updated"
+	}
+	if err != nil {
+		entry.Outcome, entry.Details["error"] = audit.Failure, err.Error()
+	}
+	s.record(req, entry)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(repository))
+}
+
+//Remove a forge repository given by its name or clone url in the repository query parameter
+func (s *Server) deleteForgeRepository(res http.ResponseWriter, req *http.Request) {
+	name := docker.RepositoryName(req.URL.Query().Get("repository"))
+	err := s.forge.Delete(name)
+	entry := audit.Entry{Action: audit.ActionForgeDelete, Target: name, Outcome: audit.Success}
+	if err != nil {
+		entry.Outcome, entry.Details = audit.Failure, map[string]string{"error": err.Error()}
+	}
+	s.record(req, entry)
+	if err == forge.ErrRepositoryNotFound {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.WriteHeader(204)
+}
+
+//Get a recent job and its logs, it is the target of the job links posted to the forges
+func (s *Server) fetchJob(res http.ResponseWriter, req *http.Request) {
+	record, ok := s.docker.Jobs.Get(mux.Vars(req)["id"])
+	if ok {
+		//The container is recreated by the update so it is looked up by name first
+		container, found := s.containers.GetByName(record.Job.Container)
+		if !found {
+			container, found = s.containers.GetById(record.Job.ContainerId)
+		}
+		ok = found && getPrincipal(req).Can(users.ActionRead, &container)
+	}
+	//Jobs of unreadable containers are reported as missing
+	if !ok {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": "Job not found"}))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(record))
+}
+
+//Get the log file of a job, the files outlive the job history
+func (s *Server) fetchJobLog(res http.ResponseWriter, req *http.Request) {
+	name, file, err := s.docker.JobLogs.Open(mux.Vars(req)["id"])
+	if err != nil {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": "Job log not found"}))
+		return
+	}
+	defer file.Close()
+	//Logs of unreadable containers are reported as missing
+	if container, found := s.containers.GetByName(name); !found || !getPrincipal(req).Can(users.ActionRead, &container) {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": "Job log not found"}))
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(200)
+	io.Copy(res, file)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"dockerci/src/utils"
+	"dockerci/src/version"
+)
+
+const readinessTimeout = 3 * time.Second
+
+//Liveness probe, the process answers
+func (s *Server) healthz(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(map[string]string{"status": "ok"}))
+}
+
+//Readiness probe : docker is reachable, the event stream is connected, the data directory is writable, the registry is loaded and docker-ci is not shutting down
+//Each check is reported with "ok" or the reason of its failure, the status is 503 if one of them fails
+func (s *Server) readyz(res http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+	checks := map[string]string{"docker": "ok", "eventStream": "ok", "store": "ok", "registry": "ok"}
+	if err := s.docker.Ping(ctx); err != nil {
+		checks["docker"] = err.Error()
+	}
+	if stream := s.docker.EventStreamState(); !stream.Connected {
+		checks["eventStream"] = "disconnected"
+		if stream.Error != "" {
+			checks["eventStream"] += ": " + stream.Error
+		}
+	}
+	if err := checkWritable(filepath.Dir(utils.DataPath("readyz"))); err != nil {
+		checks["store"] = err.Error()
+	}
+	if !s.containers.Loaded() {
+		checks["registry"] = "containers not loaded yet"
+	}
+	if s.isDraining() {
+		checks["shutdown"] = "shutting down"
+	}
+	status, ready := 200, "ready"
+	for _, check := range checks {
+		if check != "ok" {
+			status, ready = http.StatusServiceUnavailable, "not ready"
+		}
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(utils.ToJSON(map[string]interface{}{"status": ready, "checks": checks}))
+}
+
+//Get the build version, the git commit and the docker api version negotiated with the daemon
+func (s *Server) fetchVersion(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(map[string]string{
+		"version":          version.Version,
+		"commit":           version.Commit,
+		"goVersion":        runtime.Version(),
+		"dockerApiVersion": s.docker.APIVersion(),
+	}))
+}
+
+//Check that a file can be created in a directory, the directory is created if it does not exist
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
-	"log"
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
+	"dockerci/src/docker"
+	"dockerci/src/users"
+	"dockerci/src/utils"
 	"net/http"
 	"time"
 
@@ -14,35 +18,209 @@ var upgrader = websocket.Upgrader{}
 //Handler for webhooks
 //Trigger onRequest when a webhook is received
 //If it is a websocket request a stream is transmitted to request func
-func handleHook(w http.ResponseWriter, req *http.Request, onRequest RequestHandler) {
-	token := req.URL.Query().Get("token")
-	if token == "" {
-		log.Println("No token provided")
-		w.WriteHeader(http.StatusUnauthorized)
+//If the push doesn't concern the container a 204 is sent with the reason in the X-Docker-Ci-Ignored header
+func (s *Server) handleHook(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	entry := audit.Entry{Action: audit.ActionHook, Target: name, DeliveryId: deliveryId(req)}
+	container, _ := s.containers.GetByName(name)
+	if !s.allowHook(req, name, []docker.ContainerInfo{container}) {
+		s.rejectSource(w, req, entry)
+		return
+	}
+	principal, status := s.authorizeHook(req, []docker.ContainerInfo{container})
+	entry.Actor, entry.Key = actorOf(principal)
+	if status != http.StatusOK {
+		s.recordHook(req, entry, status, "")
+		w.WriteHeader(status)
+		return
+	}
+	token, ok := hookToken(req, []docker.ContainerInfo{container})
+	if !ok {
+		s.recordHook(req, entry, http.StatusBadRequest, "no token")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("No token provided"))
+		return
+	}
+	if status, reason := s.checkReplay(req); status != 0 {
+		s.recordHook(req, entry, status, reason)
+		w.WriteHeader(status)
+		w.Write([]byte(reason))
 		return
 	}
 	if req.URL.Scheme != "wss" && req.URL.Scheme != "ws" {
-		name := mux.Vars(req)["name"]
 		if len(name) == 0 {
 			w.WriteHeader(http.StatusBadRequest)
 		} else {
-			status, msg := onRequest(name, token, nil)
+			status, msg := s.handlers.OnRequest(req.Context(), name, token, parsePushEvent(req), nil)
+			s.recordHook(req, entry, status, msg)
+			if status == http.StatusNoContent {
+				w.Header().Set("X-Docker-Ci-Ignored", msg)
+				w.WriteHeader(status)
+				return
+			}
 			w.WriteHeader(status)
 			w.Write([]byte(msg))
 		}
 	} else {
 		c, err := upgrader.Upgrade(w, req, nil)
 		if err != nil {
-			log.Println(err)
+			apiLog.With("hook", name).Warnf("Error while opening the hook websocket: %v", err)
 			return
 		}
 
 		defer c.Close()
-		name := mux.Vars(req)["name"]
 		if len(name) == 0 {
 			c.WriteControl(websocket.CloseMessage, []byte("400 Bad Request"), time.Now().Add(time.Second))
 		} else {
-			onRequest(name, token, c)
+			status, msg := s.handlers.OnRequest(req.Context(), name, token, nil, c)
+			s.recordHook(req, entry, status, msg)
+		}
+	}
+}
+
+//Handler for repository webhooks
+func (s *Server) handleRepoHook(w http.ResponseWriter, req *http.Request) {
+	push := parsePushEvent(req)
+	var containers []docker.ContainerInfo
+	if push != nil {
+		containers = s.containers.GetByRepository(push.CloneUrl)
+	}
+	target := "repository"
+	if push != nil {
+		target = push.CloneUrl
+	}
+	s.handleGroupHook(w, req, target, containers, func(token string) (int, interface{}) {
+		return s.handlers.OnRepoRequest(req.Context(), token, push)
+	})
+}
+
+//Handler for compose project webhooks
+func (s *Server) handleProjectHook(w http.ResponseWriter, req *http.Request) {
+	project := mux.Vars(req)["project"]
+	push := parsePushEvent(req)
+	s.handleGroupHook(w, req, "project:"+project, s.containers.GetByProject(project), func(token string) (int, interface{}) {
+		return s.handlers.OnProjectRequest(req.Context(), project, token, push)
+	})
+}
+
+//Handler for webhooks updating a group of containers (repository, compose project)
+//Trigger onRequest and send back the result of each container update
+func (s *Server) handleGroupHook(w http.ResponseWriter, req *http.Request, target string, containers []docker.ContainerInfo, onRequest func(token string) (int, interface{})) {
+	entry := audit.Entry{Action: audit.ActionHook, Target: target, DeliveryId: deliveryId(req)}
+	if !s.allowHook(req, target, containers) {
+		s.rejectSource(w, req, entry)
+		return
+	}
+	principal, status := s.authorizeHook(req, containers)
+	entry.Actor, entry.Key = actorOf(principal)
+	if status != http.StatusOK {
+		s.recordHook(req, entry, status, "")
+		w.WriteHeader(status)
+		return
+	}
+	token, ok := hookToken(req, containers)
+	if !ok {
+		s.recordHook(req, entry, http.StatusBadRequest, "no token")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("No token provided"))
+		return
+	}
+	if status, reason := s.checkReplay(req); status != 0 {
+		s.recordHook(req, entry, status, reason)
+		w.WriteHeader(status)
+		w.Write([]byte(reason))
+		return
+	}
+	status, data := onRequest(token)
+	msg, ok := data.(string)
+	s.recordHook(req, entry, status, msg)
+	if ok {
+		if status == http.StatusNoContent {
+			w.Header().Set("X-Docker-Ci-Ignored", msg)
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(msg))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(utils.ToJSON(data))
+}
+
+//Check that a hook call can trigger all the given containers
+//Calls with an authorization header need a user or an api key with the trigger permission on every container
+//Calls without it are forge webhooks, they must be signed with the webhook secret of every container
+//The principal is nil for forge webhooks
+func (s *Server) authorizeHook(req *http.Request, containers []docker.ContainerInfo) (users.Principal, int) {
+	if req.Header.Get("Authorization") == "" {
+		if !verifyWebhook(req, containers) {
+			return nil, http.StatusUnauthorized
+		}
+		return nil, http.StatusOK
+	}
+	var principal users.Principal
+	token, err := middleware.BearerToken(req)
+	if err == nil && users.IsKeyToken(token) {
+		key, ok := s.authenticateKey(token)
+		if !ok {
+			return nil, http.StatusUnauthorized
+		}
+		principal = key
+	} else {
+		claims, err := middleware.Authenticate(req)
+		if err != nil {
+			apiLog.Warnf("Hook call refused: %v", err)
+			return nil, http.StatusUnauthorized
+		}
+		user, ok := s.users.Get(claims.Username)
+		if !ok {
+			return nil, http.StatusUnauthorized
+		}
+		principal = &user
+	}
+	for _, container := range containers {
+		if !principal.Can(users.ActionTrigger, &container) {
+			return principal, http.StatusForbidden
+		}
+	}
+	return principal, http.StatusOK
+}
+
+//Get the token given in the query of a hook call, it replaces the {{TOKEN}} placeholder of the repository links
+//It is only required if the repository link of one of the containers has the placeholder
+func hookToken(req *http.Request, containers []docker.ContainerInfo) (string, bool) {
+	token := req.URL.Query().Get("token")
+	if token != "" {
+		return token, true
+	}
+	for _, container := range containers {
+		if container.NeedsToken() {
+			apiLog.With("container", container.Name()).Warnf("No token provided for the repository")
+			return "", false
 		}
 	}
+	return "", true
+}
+
+//Reject a hook call from a source ip that is not allowed
+func (s *Server) rejectSource(w http.ResponseWriter, req *http.Request, entry audit.Entry) {
+	apiLog.With("hook", entry.Target).With("ip", s.clientIP(req)).Warnf("Hook call rejected from a source ip not allowed")
+	s.recordHook(req, entry, http.StatusForbidden, "source ip not allowed")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("Forbidden"))
+}
+
+//Record a hook call in the audit log
+//A failed delivery is forgotten by the replay cache so that it can be sent again
+func (s *Server) recordHook(req *http.Request, entry audit.Entry, status int, msg string) {
+	if status >= 500 && entry.DeliveryId != "" {
+		s.deliveries.forget(entry.DeliveryId)
+	}
+	entry.Status, entry.Outcome = status, outcomeOf(status)
+	if msg != "" {
+		entry.Details = map[string]string{"message": msg}
+	}
+	s.record(req, entry)
 }
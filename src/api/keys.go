@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"dockerci/src/audit"
+	"dockerci/src/users"
+	"dockerci/src/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type KeyRequest struct {
+	Name      string         `json:"name"`
+	Grants    []users.Grant  `json:"grants"`
+	Actions   []users.Action `json:"actions"`
+	ExpiresAt *time.Time     `json:"expiresAt"`
+}
+
+//Created key with its token, the token is only sent once
+type KeyResponse struct {
+	users.Key
+	Token string `json:"token"`
+}
+
+//Get the keys of the user, admins get all the keys or the keys of the owner given in the query
+func (s *Server) fetchKeys(res http.ResponseWriter, req *http.Request) {
+	user := getUser(req)
+	owner := user.Username
+	if user.Role == users.RoleAdmin {
+		owner = req.URL.Query().Get("owner")
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(s.keys.List(owner)))
+}
+
+//Create a key owned by the user
+func (s *Server) createKey(res http.ResponseWriter, req *http.Request) {
+	var data KeyRequest
+	if err := utils.FromJSON(req.Body, &data); err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	key, token, err := s.keys.Create(users.Key{
+		Name:      data.Name,
+		Owner:     getUser(req).Username,
+		Grants:    data.Grants,
+		Actions:   data.Actions,
+		ExpiresAt: data.ExpiresAt,
+	})
+	entry := audit.Entry{Action: audit.ActionKeyCreate, Target: key.Id, Outcome: audit.Success, Details: map[string]string{"name": data.Name}}
+	if err != nil {
+		entry.Outcome, entry.Details["error"] = audit.Failure, err.Error()
+	}
+	s.record(req, entry)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(201)
+	res.Write(utils.ToJSON(KeyResponse{key, token}))
+}
+
+//Revoke a key of the user, admins can revoke any key
+func (s *Server) revokeKey(res http.ResponseWriter, req *http.Request) {
+	user := getUser(req)
+	key, ok := s.keys.Get(mux.Vars(req)["id"])
+	//Keys of other users are reported as missing so that their ids can't be guessed
+	if !ok || (key.Owner != user.Username && user.Role != users.RoleAdmin) {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": users.ErrKeyNotFound.Error()}))
+		return
+	}
+	err := s.keys.Revoke(key.Id)
+	entry := audit.Entry{Action: audit.ActionKeyRevoke, Target: key.Id, Outcome: audit.Success, Details: map[string]string{"name": key.Name, "owner": key.Owner}}
+	if err != nil {
+		entry.Outcome, entry.Details["error"] = audit.Failure, err.Error()
+	}
+	s.record(req, entry)
+	if err == users.ErrKeyNotFound {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.WriteHeader(204)
+}
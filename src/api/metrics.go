@@ -0,0 +1,40 @@
+package api
+
+import (
+	"dockerci/src/utils"
+	"net/http"
+	"sync"
+)
+
+//Number of hook calls answered with each status code
+type hookStatuses struct {
+	mutex  sync.Mutex
+	counts map[int]uint64
+}
+
+//Count the hook calls by status code
+func (s *Server) countHooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		writer := &utils.StatusWriter{ResponseWriter: res}
+		next.ServeHTTP(writer, req)
+		s.hooks.mutex.Lock()
+		s.hooks.counts[writer.Status()]++
+		s.hooks.mutex.Unlock()
+	})
+}
+
+//Get the number of hook calls answered with each status code
+func (s *Server) HookRequests() map[int]uint64 {
+	s.hooks.mutex.Lock()
+	defer s.hooks.mutex.Unlock()
+	requests := make(map[int]uint64, len(s.hooks.counts))
+	for status, count := range s.hooks.counts {
+		requests[status] = count
+	}
+	return requests
+}
+
+//Serve a handler outside of the authenticated api, it must be called before Serve
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.router.Handle(path, handler)
+}
@@ -1,54 +1,253 @@
 package middleware
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/logger"
+	"dockerci/src/utils"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
 )
 
+//Minimum length of the PRIVATE_KEY signing the tokens
+const MinKeyLength = 32
+
 type JWTClaims struct {
-	username string `json:"username"`
+	Username  string `json:"username"`
+	TokenType string `json:"typ"`
 	jwt.StandardClaims
 }
 
+//Pair of tokens issued on login and refresh
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+type contextKey string
+
+const claimsKey contextKey = "claims"
+
+//Token id -> expiration of the revoked tokens that are not expired yet
+//They are persisted to path so that the logged out refresh tokens stay revoked after a restart
+var revoked = struct {
+	sync.Mutex
+	tokens map[string]int64
+	path   string
+}{tokens: make(map[string]int64)}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		_, err := getPayload(auth)
+		claims, err := Authenticate(r)
 		if err != nil {
-			log.Println(err)
+			logger.Default.With("component", "api").Warnf("Request refused: %v", err)
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized"))
 		} else {
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
 		}
 	})
 }
 
-func getPayload(auth string) (*JWTClaims, error) {
-	auth = strings.TrimSpace(auth)
-	if auth == "" {
-		return nil, errors.New("authorization header is empty")
-	} else {
-		token := strings.SplitAfter(auth, " ")[1]
-		if token != "" {
-			payload, err := jwt.ParseWithClaims(token, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(os.Getenv("JWT_SECRET")), nil
-			})
-			if err != nil {
-				return nil, err
-			}
-			if claims, ok := payload.Claims.(*JWTClaims); ok && payload.Valid {
-				return claims, nil
-			} else {
-				return nil, err
-			}
-		} else {
-			return nil, errors.New("authorization header is empty")
+//Get the claims from the authorization header of a request
+func Authenticate(r *http.Request) (*JWTClaims, error) {
+	token, err := BearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyToken(token, AccessToken)
+}
+
+//Get the bearer token of the authorization header of a request (access token or api key)
+func BearerToken(r *http.Request) (string, error) {
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) == 0 {
+		return "", errors.New("authorization header is empty")
+	}
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", errors.New("authorization header is malformed")
+	}
+	return parts[1], nil
+}
+
+//Browsers can't set headers on websocket requests, the token of a websocket upgrade is then given in the access_token query param
+//It is moved to the authorization header so that it is not accepted on the other requests and does not stay in the url
+func WebsocketToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if token := query.Get("access_token"); token != "" && r.Header.Get("Authorization") == "" && websocket.IsWebSocketUpgrade(r) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		query.Del("access_token")
+		r.URL.RawQuery = query.Encode()
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Get the claims of the authenticated request
+func GetClaims(r *http.Request) *JWTClaims {
+	claims, _ := r.Context().Value(claimsKey).(*JWTClaims)
+	return claims
+}
+
+//Issue an access token and a refresh token for a user
+func IssueTokens(username string) (*TokenPair, error) {
+	now := time.Now()
+	accessExp := now.Add(tokenTTL("ACCESS_TOKEN_TTL", time.Hour))
+	token, err := signToken(username, AccessToken, now, accessExp)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := signToken(username, RefreshToken, now, now.Add(tokenTTL("REFRESH_TOKEN_TTL", 7*24*time.Hour)))
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Token: token, RefreshToken: refreshToken, ExpiresAt: accessExp.Unix()}, nil
+}
+
+//Verify a token signature, its time claims, its type and check that it is not revoked
+func VerifyToken(token string, tokenType string) (*JWTClaims, error) {
+	payload, err := jwt.ParseWithClaims(token, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
 		}
+		return signingKey()
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := payload.Claims.(*JWTClaims)
+	if !ok || !payload.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.ExpiresAt == 0 || claims.Id == "" {
+		return nil, errors.New("token has no expiration")
+	}
+	if claims.TokenType != tokenType {
+		return nil, errors.New("invalid token type")
+	}
+	if isRevoked(claims.Id) {
+		return nil, errors.New("token is revoked")
+	}
+	return claims, nil
+}
+
+//Load the revoked tokens from a json file, the file is created on the first revocation
+//The following revocations are written to the file
+func LoadRevoked(path string) error {
+	revoked.Lock()
+	defer revoked.Unlock()
+	revoked.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tokens := make(map[string]int64)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for id, exp := range tokens {
+		if exp >= now {
+			revoked.tokens[id] = exp
+		}
+	}
+	return nil
+}
+
+//Revoke a token until its expiration
+//It returns false if the token was already revoked, a refresh token can then only be exchanged once
+func Revoke(claims *JWTClaims) bool {
+	revoked.Lock()
+	defer revoked.Unlock()
+	if _, ok := revoked.tokens[claims.Id]; ok {
+		return false
+	}
+	now := time.Now().Unix()
+	for id, exp := range revoked.tokens {
+		if exp < now {
+			delete(revoked.tokens, id)
+		}
+	}
+	revoked.tokens[claims.Id] = claims.ExpiresAt
+	if revoked.path != "" {
+		if err := saveRevoked(); err != nil {
+			logger.Default.With("component", "api").Errorf("Error while saving the revoked tokens: %v", err)
+		}
+	}
+	return true
+}
+
+//Write the revoked tokens to their file, the lock must be held
+func saveRevoked() error {
+	data, err := json.MarshalIndent(revoked.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(revoked.path, data, 0600)
+}
+
+func isRevoked(id string) bool {
+	revoked.Lock()
+	defer revoked.Unlock()
+	_, ok := revoked.tokens[id]
+	return ok
+}
+
+func signToken(username string, tokenType string, now time.Time, exp time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		Username:  username,
+		TokenType: tokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        utils.RandomHex(16),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: exp.Unix(),
+		},
+	})
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	return token.SignedString(key)
+}
+
+//Check the key signing the tokens, anyone could forge a token signed with an empty or short key
+func CheckSigningKey() error {
+	_, err := signingKey()
+	return err
+}
+
+func signingKey() ([]byte, error) {
+	key := os.Getenv("PRIVATE_KEY")
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("PRIVATE_KEY must be at least %d characters long", MinKeyLength)
+	}
+	return []byte(key), nil
+}
+
+//Get a token lifetime from an env var with a default value
+func tokenTTL(env string, fallback time.Duration) time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv(env)); err == nil && ttl > 0 {
+		return ttl
 	}
+	return fallback
 }
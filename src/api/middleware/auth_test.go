@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		token  string
+		err    bool
+	}{
+		{"empty header", "", "", true},
+		{"blank header", "   ", "", true},
+		{"no space", "Bearertoken", "", true},
+		{"scheme only", "Bearer", "", true},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", "", true},
+		{"extra fields", "Bearer token extra", "", true},
+		{"valid", "Bearer token", "token", false},
+		{"lowercase scheme", "bearer token", "token", false},
+		{"surrounding spaces", "  Bearer   token ", "token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			token, err := BearerToken(req)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			}
+			if token != test.token {
+				t.Errorf("got token %q, want %q", token, test.token)
+			}
+		})
+	}
+}
+
+func TestBearerTokenIgnoresQuery(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/?access_token=token", nil)
+	if _, err := BearerToken(req); err == nil {
+		t.Error("query token accepted outside of the websocket")
+	}
+}
+
+func TestWebsocketToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		websocket bool
+		header    string
+	}{
+		{"websocket upgrade", true, "Bearer token"},
+		{"plain request", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/events?access_token=token&container=app", nil)
+			if test.websocket {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			var got, query string
+			WebsocketToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, query = r.Header.Get("Authorization"), r.URL.RawQuery
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			if got != test.header {
+				t.Errorf("got authorization %q, want %q", got, test.header)
+			}
+			if query != "container=app" {
+				t.Errorf("got query %q, want the token removed", query)
+			}
+		})
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	t.Setenv("PRIVATE_KEY", testKey)
+	now := time.Now()
+	claims := func(tokenType string, notBefore time.Time, exp time.Time) JWTClaims {
+		return JWTClaims{
+			Username:  "admin",
+			TokenType: tokenType,
+			StandardClaims: jwt.StandardClaims{
+				Id:        "id-" + tokenType + exp.String(),
+				IssuedAt:  now.Unix(),
+				NotBefore: notBefore.Unix(),
+				ExpiresAt: exp.Unix(),
+			},
+		}
+	}
+	hmac := func(claims JWTClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := claims(AccessToken, now, now.Add(time.Hour))
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256, err := jwt.NewWithClaims(jwt.SigningMethodRS256, valid).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedClaims := claims(AccessToken, now, now.Add(2*time.Hour))
+	Revoke(&revokedClaims)
+	noExp := valid
+	noExp.ExpiresAt = 0
+	wrongKey, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte("another key of at least 32 bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenType string
+		err       bool
+	}{
+		{"valid access token", hmac(valid), AccessToken, false},
+		{"valid refresh token", hmac(claims(RefreshToken, now, now.Add(time.Hour))), RefreshToken, false},
+		{"garbage", "not.a.token", AccessToken, true},
+		{"empty", "", AccessToken, true},
+		{"expired", hmac(claims(AccessToken, now.Add(-2*time.Hour), now.Add(-time.Hour))), AccessToken, true},
+		{"no expiration", hmac(noExp), AccessToken, true},
+		{"not before in the future", hmac(claims(AccessToken, now.Add(time.Hour), now.Add(2*time.Hour))), AccessToken, true},
+		{"refresh token used as access token", hmac(claims(RefreshToken, now, now.Add(time.Hour))), AccessToken, true},
+		{"access token used as refresh token", hmac(valid), RefreshToken, true},
+		{"revoked", hmac(revokedClaims), AccessToken, true},
+		{"alg none", none, AccessToken, true},
+		{"alg RS256", rs256, AccessToken, true},
+		{"signed with another key", wrongKey, AccessToken, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := VerifyToken(test.token, test.tokenType)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			}
+			if err == nil && claims.Username != "admin" {
+				t.Errorf("got username %q, want admin", claims.Username)
+			}
+		})
+	}
+}
+
+func TestIssuedTokensVerify(t *testing.T) {
+	t.Setenv("PRIVATE_KEY", testKey)
+	pair, err := IssueTokens("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(pair.Token, AccessToken); err != nil {
+		t.Errorf("access token: %v", err)
+	}
+	if _, err := VerifyToken(pair.RefreshToken, RefreshToken); err != nil {
+		t.Errorf("refresh token: %v", err)
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	for _, key := range []string{"", "short"} {
+		t.Setenv("PRIVATE_KEY", key)
+		if err := CheckSigningKey(); err == nil {
+			t.Errorf("key %q accepted", key)
+		}
+		if _, err := IssueTokens("admin"); err == nil {
+			t.Errorf("token signed with key %q", key)
+		}
+	}
+	t.Setenv("PRIVATE_KEY", testKey)
+	if err := CheckSigningKey(); err != nil {
+		t.Error(err)
+	}
+}
+
+//Forget the revoked tokens as a restart does, the file is kept
+func restart(t *testing.T, path string) {
+	revoked.Lock()
+	revoked.tokens, revoked.path = make(map[string]int64), ""
+	revoked.Unlock()
+	if err := LoadRevoked(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokedTokensSurviveARestart(t *testing.T) {
+	t.Setenv("PRIVATE_KEY", testKey)
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	restart(t, path)
+	t.Cleanup(func() { restart(t, "") })
+	pair, err := IssueTokens("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := VerifyToken(pair.RefreshToken, RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Revoke(claims)
+	//An expired revocation is not loaded again
+	Revoke(&JWTClaims{StandardClaims: jwt.StandardClaims{Id: "expired", ExpiresAt: time.Now().Add(-time.Hour).Unix()}})
+	restart(t, path)
+	if _, err := VerifyToken(pair.RefreshToken, RefreshToken); err == nil {
+		t.Error("logged out refresh token accepted after a restart")
+	}
+	if isRevoked("expired") {
+		t.Error("expired revocation loaded")
+	}
+	if _, err := VerifyToken(pair.Token, AccessToken); err != nil {
+		t.Errorf("access token refused: %v", err)
+	}
+}
+
+func TestRevokeOnce(t *testing.T) {
+	claims := &JWTClaims{StandardClaims: jwt.StandardClaims{Id: "refresh", ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	t.Cleanup(func() { restart(t, "") })
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	exchanged := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if Revoke(claims) {
+				mutex.Lock()
+				exchanged++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if exchanged != 1 {
+		t.Errorf("token revoked %d times, want 1", exchanged)
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Maximum number of clients tracked by a limiter
+const maxBuckets = 10000
+
+//Token bucket of a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//Per client token bucket rate limiter
+type RateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 //Tokens added per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+//Create a limiter allowing a number of requests per minute with bursts of the same size
+//The limit is read from an env var, nil is returned if the limit is 0 (no limit)
+func NewRateLimiter(env string, fallback int) *RateLimiter {
+	perMinute := fallback
+	if value, err := strconv.Atoi(os.Getenv(env)); err == nil {
+		perMinute = value
+	}
+	if perMinute <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+//Take a token for a client, the time to wait for the next token is returned if there is none
+func (limiter *RateLimiter) Allow(client string) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := time.Now()
+	b, ok := limiter.buckets[client]
+	if !ok {
+		if len(limiter.buckets) >= maxBuckets {
+			limiter.prune(now)
+		}
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[client] = b
+	}
+	b.tokens = math.Min(limiter.burst, b.tokens+now.Sub(b.last).Seconds()*limiter.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limiter.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+//Limit the requests of each client, the client of a request is given by the key function
+//Requests over the limit get a 429 with a Retry-After header
+func (limiter *RateLimiter) Middleware(key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := limiter.Allow(key(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("Too many requests"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Remove the buckets that are full again, all the buckets are removed if it is not enough
+//The lock must be held
+func (limiter *RateLimiter) prune(now time.Time) {
+	for client, b := range limiter.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+	if len(limiter.buckets) >= maxBuckets {
+		limiter.buckets = make(map[string]*bucket)
+	}
+}
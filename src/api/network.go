@@ -0,0 +1,165 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"dockerci/src/docker"
+)
+
+//Label restricting the source ips allowed to call the hooks of a container
+const hookAllowLabel = "docker-ci.hook-allow"
+
+//Source ip configuration loaded from the TRUSTED_PROXIES and HOOK_ALLOW env vars
+type network struct {
+	trustedProxies []*net.IPNet
+	hookAllow      []*net.IPNet //Global allowlist, every ip is allowed if nil
+	mutex          sync.Mutex
+	rejected       map[string]uint64 //Hook target -> calls rejected by the allowlist
+}
+
+func newNetwork() *network {
+	network := &network{rejected: make(map[string]uint64)}
+	network.trustedProxies, _ = parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if allow := os.Getenv("HOOK_ALLOW"); strings.TrimSpace(allow) != "" {
+		network.hookAllow, _ = parseCIDRs(allow)
+		//An allowlist without valid entry denies every call instead of allowing them
+		if network.hookAllow == nil {
+			network.hookAllow = make([]*net.IPNet, 0)
+		}
+	}
+	return network
+}
+
+//Get the ip of the client of a request
+//When the request comes from a trusted proxy, the X-Forwarded-For hops are read from the closest one
+//and the first hop that is not a trusted proxy is the client
+func (s *Server) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !containsIP(s.network.trustedProxies, net.ParseIP(ip)) {
+		return ip
+	}
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !containsIP(s.network.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+//Check that the client of a hook call is allowed to trigger all the containers
+//The docker-ci.hook-allow label of a container replaces the global allowlist
+func (s *Server) allowHook(req *http.Request, target string, containers []docker.ContainerInfo) bool {
+	ip := net.ParseIP(s.clientIP(req))
+	allowed := true
+	if len(containers) == 0 {
+		allowed = s.network.hookAllow == nil || containsIP(s.network.hookAllow, ip)
+	}
+	for _, container := range containers {
+		allowlist := s.network.hookAllow
+		if label, ok := container.Labels[hookAllowLabel]; ok && strings.TrimSpace(label) != "" {
+			var err error
+			if allowlist, err = parseCIDRs(label); err != nil {
+				apiLog.With("container", container.Name()).Warnf("Invalid %s label: %v", hookAllowLabel, err)
+			}
+			if allowlist == nil {
+				allowlist = make([]*net.IPNet, 0)
+			}
+		}
+		if allowlist != nil && !containsIP(allowlist, ip) {
+			allowed = false
+			break
+		}
+	}
+	if !allowed {
+		//Unknown targets are counted together so that random hook names can't grow the counters
+		known := false
+		for _, container := range containers {
+			known = known || container.Id != ""
+		}
+		if !known {
+			target = "unknown"
+		}
+		s.network.mutex.Lock()
+		s.network.rejected[target]++
+		s.network.mutex.Unlock()
+	}
+	return allowed
+}
+
+//Get the number of hook calls rejected by the allowlists for each target
+func (s *Server) HookRejections() map[string]uint64 {
+	s.network.mutex.Lock()
+	defer s.network.mutex.Unlock()
+	rejections := make(map[string]uint64, len(s.network.rejected))
+	for target, count := range s.network.rejected {
+		rejections[target] = count
+	}
+	return rejections
+}
+
+//Parse a comma separated list of CIDRs or ips, the invalid entries are skipped and the last error is returned
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	var lastErr error
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			apiLog.Warnf("Invalid CIDR: %v", err)
+			lastErr = err
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks, lastErr
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Parse a X-Forwarded-For hop, some proxies add the port
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
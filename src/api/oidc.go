@@ -0,0 +1,591 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
+	"dockerci/src/users"
+	"dockerci/src/utils"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//Provider name of the users created from an OpenID Connect login
+const OIDCProvider = "oidc"
+
+const (
+	oidcLoginTTL     = 10 * time.Minute //Time given to the user to log in to the provider
+	jwksTTL          = time.Hour        //Time after which the provider keys are fetched again
+	jwksMinRefresh   = time.Minute      //Minimum time between two fetches when an unknown key is used
+	oidcClockLeeway  = time.Minute
+	oidcMaxPending   = 1000 //Maximum number of logins waiting for the provider callback
+	oidcDefaultScope = "openid profile email"
+	oidcStateCookie  = "dci_oidc_state" //Cookie binding a login to the browser that started it
+)
+
+//OpenID Connect configuration loaded from the OIDC_* env vars
+type oidcConfig struct {
+	issuer        string
+	clientId      string
+	clientSecret  string
+	redirectURL   string
+	scopes        string
+	usernameClaim string
+	roleClaim     string
+	roles         map[string]users.Role //Role claim value -> docker-ci role
+	defaultRole   users.Role            //Role given when no claim value is mapped, the login is refused if empty
+}
+
+//Endpoints from the provider discovery document
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//Login started by a user and waiting for the provider callback
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	binding  string //Value of the state cookie of the browser that started the login
+	expires  time.Time
+}
+
+//OpenID Connect authorization code flow with PKCE
+type OIDC struct {
+	config        oidcConfig
+	client        *http.Client
+	mutex         sync.Mutex
+	fetch         sync.Mutex //Held during the key set fetch instead of mutex, the concurrent logins wait for the same fetch
+	discovery     *oidcDiscovery
+	keys          map[string]interface{} //Key id -> public key of the provider
+	keysFetchedAt time.Time
+	logins        map[string]pendingLogin //State -> login
+}
+
+//Create the OpenID Connect client from the env vars, nil is returned if OIDC_ISSUER is not set
+func NewOIDC() *OIDC {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil
+	}
+	config := oidcConfig{
+		issuer:        issuer,
+		clientId:      os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:        envOr("OIDC_SCOPES", oidcDefaultScope),
+		usernameClaim: envOr("OIDC_USERNAME_CLAIM", "preferred_username"),
+		roleClaim:     envOr("OIDC_ROLE_CLAIM", "groups"),
+		roles:         make(map[string]users.Role),
+		defaultRole:   users.Role(os.Getenv("OIDC_DEFAULT_ROLE")),
+	}
+	if config.redirectURL == "" {
+		config.redirectURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/") + "/api/auth/oidc/callback"
+	}
+	for _, mapping := range strings.Split(os.Getenv("OIDC_ROLES"), ",") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if role := users.Role(strings.TrimSpace(parts[1])); role.Valid() {
+			config.roles[strings.TrimSpace(parts[0])] = role
+		} else {
+			apiLog.Warnf("Invalid role in OIDC_ROLES: %s", parts[1])
+		}
+	}
+	if config.defaultRole != "" && !config.defaultRole.Valid() {
+		apiLog.Warnf("Invalid OIDC_DEFAULT_ROLE: %s", config.defaultRole)
+		config.defaultRole = ""
+	}
+	apiLog.Infof("OpenID Connect login enabled with %s", issuer)
+	return &OIDC{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]interface{}),
+		logins: make(map[string]pendingLogin),
+	}
+}
+
+//Start a login and get the url of the provider authorization endpoint
+//The binding must be kept by the browser and given back to Exchange so that a callback can't be completed by another browser
+func (o *OIDC) AuthURL() (authURL string, binding string, err error) {
+	discovery, err := o.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, login := utils.RandomHex(16), pendingLogin{
+		verifier: utils.RandomHex(32),
+		nonce:    utils.RandomHex(16),
+		binding:  utils.RandomHex(16),
+		expires:  time.Now().Add(oidcLoginTTL),
+	}
+	o.mutex.Lock()
+	o.pruneLogins()
+	if len(o.logins) >= oidcMaxPending {
+		o.mutex.Unlock()
+		return "", "", errors.New("too many pending logins")
+	}
+	o.logins[state] = login
+	o.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.clientId},
+		"redirect_uri":          {o.config.redirectURL},
+		"scope":                 {o.config.scopes},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), login.binding, nil
+}
+
+//Exchange the authorization code of a callback and get the username and the role of the user
+//The binding is the one given by AuthURL to the browser that started the login
+func (o *OIDC) Exchange(code string, state string, binding string) (string, users.Role, error) {
+	o.mutex.Lock()
+	login, ok := o.logins[state]
+	delete(o.logins, state)
+	o.mutex.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return "", "", errors.New("unknown or expired login state")
+	}
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(login.binding)) != 1 {
+		return "", "", errors.New("login started by another browser")
+	}
+	discovery, err := o.discover()
+	if err != nil {
+		return "", "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.redirectURL},
+		"client_id":     {o.config.clientId},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.clientId), url.QueryEscape(o.config.clientSecret))
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return "", "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if tokens.Error != "" {
+		return "", "", fmt.Errorf("token endpoint error: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || tokens.IdToken == "" {
+		return "", "", fmt.Errorf("token endpoint returned %d without id token", res.StatusCode)
+	}
+	claims, err := o.verifyIdToken(tokens.IdToken, login.nonce)
+	if err != nil {
+		return "", "", err
+	}
+	return o.identity(claims)
+}
+
+//Verify the signature and the claims of an id token
+func (o *OIDC) verifyIdToken(raw string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	//Time claims are checked below with a leeway for the clock skew with the provider
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return o.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.config.issuer {
+		return nil, errors.New("invalid id token issuer")
+	}
+	if !audienceContains(claims["aud"], o.config.clientId) {
+		return nil, errors.New("invalid id token audience")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("invalid id token nonce")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-oidcClockLeeway).Unix() > int64(exp) {
+		return nil, errors.New("id token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockLeeway).Unix() < int64(nbf) {
+		return nil, errors.New("id token is not valid yet")
+	}
+	return claims, nil
+}
+
+//Get the username and the role from the id token claims
+//The highest mapped role is kept when the role claim has several values
+func (o *OIDC) identity(claims jwt.MapClaims) (string, users.Role, error) {
+	username, _ := claimValue(claims, o.config.usernameClaim).(string)
+	if username == "" {
+		return "", "", fmt.Errorf("id token has no %s claim", o.config.usernameClaim)
+	}
+	var values []string
+	switch value := claimValue(claims, o.config.roleClaim).(type) {
+	case string:
+		values = append(values, value)
+	case []interface{}:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := o.config.defaultRole
+	for _, value := range values {
+		if mapped, ok := o.config.roles[value]; ok && roleRank(mapped) > roleRank(role) {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return "", "", fmt.Errorf("no role mapped for user %s", username)
+	}
+	return username, role, nil
+}
+
+//Get the discovery document of the provider, it is only fetched once it has been successfully loaded
+func (o *OIDC) discover() (*oidcDiscovery, error) {
+	o.mutex.Lock()
+	discovery := o.discovery
+	o.mutex.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+	discovery = &oidcDiscovery{}
+	if err := o.getJSON(o.config.issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.config.issuer {
+		return nil, fmt.Errorf("discovery issuer %s doesn't match %s", discovery.Issuer, o.config.issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	o.mutex.Lock()
+	o.discovery = discovery
+	o.mutex.Unlock()
+	return discovery, nil
+}
+
+//Get a public key of the provider from the cached key set
+//The key set is fetched again when it is stale or when an unknown key is used, at most once per jwksMinRefresh
+func (o *OIDC) key(kid string) (interface{}, error) {
+	if cached, _, refresh, err := o.lookupKey(kid); !refresh {
+		return cached, err
+	}
+	o.fetch.Lock()
+	defer o.fetch.Unlock()
+	//The key set may have been fetched by a concurrent login meanwhile
+	cached, found, refresh, err := o.lookupKey(kid)
+	if !refresh {
+		return cached, err
+	}
+	o.mutex.Lock()
+	discovery := o.discovery
+	o.mutex.Unlock()
+	if discovery == nil {
+		return nil, errors.New("provider is not discovered")
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	//The lock is not held during the fetch so that a slow provider doesn't block the other logins
+	if err := o.getJSON(discovery.JwksURI, &set); err != nil {
+		//A stale key is still better than no login when the provider is unreachable
+		if found {
+			apiLog.Warnf("Provider keys refresh failed: %v", err)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("jwks fetch failed: %v", err)
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		} else {
+			apiLog.Warnf("Ignoring provider key %s: %v", jwk.Kid, err)
+		}
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.keys = keys
+	o.keysFetchedAt = time.Now()
+	if key, ok := o.cachedKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+//Look a key up in the cached key set, refresh is true if the key set has to be fetched again
+func (o *OIDC) lookupKey(kid string) (key interface{}, found bool, refresh bool, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	age := time.Since(o.keysFetchedAt)
+	key, found = o.cachedKey(kid)
+	if found && age < jwksTTL {
+		return key, true, false, nil
+	}
+	if !found && age < jwksMinRefresh {
+		return nil, false, false, fmt.Errorf("unknown key %s", kid)
+	}
+	return key, found, true, nil
+}
+
+//Get a key from the cache, a token without key id can only use a key set with a single key
+//The lock must be held
+func (o *OIDC) cachedKey(kid string) (interface{}, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+//Remove the expired pending logins, the lock must be held
+func (o *OIDC) pruneLogins() {
+	now := time.Now()
+	for state, login := range o.logins {
+		if now.After(login.expires) {
+			delete(o.logins, state)
+		}
+	}
+}
+
+func (o *OIDC) getJSON(url string, obj interface{}) error {
+	res, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(obj)
+}
+
+//Build the public key of a RSA or EC json web key
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+//Get a claim from a dotted path (e.g: realm_access.roles)
+func claimValue(claims jwt.MapClaims, path string) interface{} {
+	var value interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+//The aud claim is either a string or an array of strings
+func audienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func roleRank(role users.Role) int {
+	switch role {
+	case users.RoleAdmin:
+		return 3
+	case users.RoleDeployer:
+		return 2
+	case users.RoleViewer:
+		return 1
+	}
+	return 0
+}
+
+func envOr(env string, fallback string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return fallback
+}
+
+//Redirect the user to the provider login page
+//The login is bound to the browser with a cookie checked by the callback, so that a callback url can't log someone else in
+func (s *Server) oidcLogin(res http.ResponseWriter, req *http.Request) {
+	authURL, binding, err := s.oidc.AuthURL()
+	if err != nil {
+		apiLog.Errorf("OpenID Connect login failed: %v", err)
+		redirectToDashboard(res, req, url.Values{"error": {"SSO is unavailable"}})
+		return
+	}
+	http.SetCookie(res, stateCookie(binding, int(oidcLoginTTL.Seconds())))
+	http.Redirect(res, req, authURL, http.StatusFound)
+}
+
+//Handle the provider callback and give the docker-ci tokens to the dashboard
+func (s *Server) oidcCallback(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if err := query.Get("error"); err != "" {
+		apiLog.Warnf("OpenID Connect login refused by the provider: %s %s", err, query.Get("error_description"))
+		s.record(req, audit.Entry{Action: audit.ActionLoginOIDC, Outcome: audit.Denied, Details: map[string]string{"error": err}})
+		redirectToDashboard(res, req, url.Values{"error": {"SSO login refused"}})
+		return
+	}
+	var binding string
+	if cookie, err := req.Cookie(oidcStateCookie); err == nil {
+		binding = cookie.Value
+	}
+	http.SetCookie(res, stateCookie("", -1))
+	username, role, err := s.oidc.Exchange(query.Get("code"), query.Get("state"), binding)
+	if err != nil {
+		apiLog.Warnf("OpenID Connect login failed: %v", err)
+		s.record(req, audit.Entry{Action: audit.ActionLoginOIDC, Actor: username, Outcome: audit.Failure, Details: map[string]string{"error": err.Error()}})
+		redirectToDashboard(res, req, url.Values{"error": {"SSO login failed"}})
+		return
+	}
+	user, err := s.users.Provision(username, role, OIDCProvider)
+	if err != nil {
+		apiLog.With("user", username).Errorf("OpenID Connect login failed: %v", err)
+		s.record(req, audit.Entry{Action: audit.ActionLoginOIDC, Actor: username, Outcome: audit.Failure, Details: map[string]string{"error": err.Error()}})
+		redirectToDashboard(res, req, url.Values{"error": {"SSO login failed"}})
+		return
+	}
+	tokens, err := middleware.IssueTokens(user.Username)
+	if err != nil {
+		apiLog.With("user", user.Username).Errorf("Error while issuing tokens: %v", err)
+		redirectToDashboard(res, req, url.Values{"error": {"Internal server error"}})
+		return
+	}
+	s.record(req, audit.Entry{Action: audit.ActionLoginOIDC, Actor: user.Username, Outcome: audit.Success, Details: map[string]string{"role": string(user.Role)}})
+	redirectToDashboard(res, req, url.Values{"token": {tokens.Token}, "refreshToken": {tokens.RefreshToken}})
+}
+
+//Cookie of the login binding, it is only sent to the callback and a negative max age removes it
+//Lax is needed for the cookie to be sent with the redirection of the provider
+func stateCookie(binding string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    binding,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(os.Getenv("BASE_URL"), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+//Get the available login methods
+func (s *Server) fetchAuthProviders(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(map[string]bool{"password": true, "oidc": s.oidc != nil}))
+}
+
+//Redirect to the dashboard with values in the fragment so that they are never sent to a server
+func redirectToDashboard(res http.ResponseWriter, req *http.Request, values url.Values) {
+	http.Redirect(res, req, strings.TrimSuffix(os.Getenv("BASE_URL"), "/")+"/#"+values.Encode(), http.StatusFound)
+}
@@ -0,0 +1,386 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dockerci/src/audit"
+	"dockerci/src/users"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testClientId = "docker-ci"
+
+//Code issued by the mock provider with the PKCE challenge and the nonce of the authorization request
+type mockCode struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+//Local OpenID Connect provider serving the discovery document, the key set and the token endpoint
+type mockProvider struct {
+	*httptest.Server
+	t          *testing.T
+	mutex      sync.Mutex
+	keys       map[string]*rsa.PrivateKey //Key id -> key served in the key set
+	signingKid string
+	codes      map[string]mockCode
+	jwksCalls  int
+	fetching   chan struct{} //Receives a value when the key set is requested, if it is set
+	slowKeys   chan struct{} //The key set is served once it is closed, if it is set
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	provider := &mockProvider{t: t, keys: make(map[string]*rsa.PrivateKey), codes: make(map[string]mockCode)}
+	provider.rotate("key-1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", provider.serveKeys)
+	mux.HandleFunc("/token", provider.serveToken)
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+//Replace the signing key, the former keys are no longer served
+func (provider *mockProvider) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		provider.t.Fatal(err)
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.keys = map[string]*rsa.PrivateKey{kid: key}
+	provider.signingKid = kid
+}
+
+func (provider *mockProvider) serveKeys(res http.ResponseWriter, req *http.Request) {
+	if provider.slowKeys != nil {
+		provider.fetching <- struct{}{}
+		<-provider.slowKeys
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.jwksCalls++
+	keys := make([]jsonWebKey, 0)
+	for kid, key := range provider.keys {
+		keys = append(keys, jsonWebKey{
+			Kid: kid,
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(res).Encode(map[string][]jsonWebKey{"keys": keys})
+}
+
+//Check the code and its PKCE verifier and issue an id token with the nonce of the authorization request
+func (provider *mockProvider) serveToken(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	code, ok := provider.codes[req.Form.Get("code")]
+	delete(provider.codes, req.Form.Get("code"))
+	challenge := sha256.Sum256([]byte(req.Form.Get("code_verifier")))
+	if !ok || req.Form.Get("grant_type") != "authorization_code" || req.Form.Get("client_id") != testClientId ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		res.WriteHeader(400)
+		json.NewEncoder(res).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := jwt.MapClaims{
+		"iss":   provider.URL,
+		"aud":   testClientId,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": code.nonce,
+	}
+	for name, value := range code.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = provider.signingKid
+	idToken, err := token.SignedString(provider.keys[provider.signingKid])
+	if err != nil {
+		provider.t.Fatal(err)
+	}
+	json.NewEncoder(res).Encode(map[string]string{"id_token": idToken})
+}
+
+//Follow an authorization url like the provider login page and get the code of the callback
+func (provider *mockProvider) authorize(authURL string, claims jwt.MapClaims) (code string, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		provider.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		provider.t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+	code = "code-" + query.Get("state")
+	provider.mutex.Lock()
+	provider.codes[code] = mockCode{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	provider.mutex.Unlock()
+	return code, query.Get("state")
+}
+
+func newTestOIDC(t *testing.T, provider *mockProvider) *OIDC {
+	t.Setenv("OIDC_ISSUER", provider.URL)
+	t.Setenv("OIDC_CLIENT_ID", testClientId)
+	t.Setenv("OIDC_ROLE_CLAIM", "groups")
+	t.Setenv("OIDC_ROLES", "ci-admins=admin,devs=deployer")
+	t.Setenv("OIDC_DEFAULT_ROLE", "")
+	t.Setenv("BASE_URL", "https://ci.example.com")
+	return NewOIDC()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDC(t, provider)
+	authURL, binding, err := o.AuthURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := provider.authorize(authURL, jwt.MapClaims{"preferred_username": "alice", "groups": []string{"devs", "ci-admins"}})
+	username, role, err := o.Exchange(code, state, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || role != users.RoleAdmin {
+		t.Errorf("got %s with role %s, want alice with role admin", username, role)
+	}
+	if _, _, err := o.Exchange(code, state, binding); err == nil {
+		t.Error("login state accepted twice")
+	}
+}
+
+func TestOIDCRejectedLogins(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDC(t, provider)
+	claims := jwt.MapClaims{"preferred_username": "alice", "groups": "devs"}
+	tests := []struct {
+		name   string
+		tamper func(code mockCode) mockCode
+		state  func(state string) string
+		bind   func(binding string) string
+	}{
+		{name: "PKCE verifier of another login", tamper: func(code mockCode) mockCode {
+			other := sha256.Sum256([]byte("another verifier"))
+			code.challenge = base64.RawURLEncoding.EncodeToString(other[:])
+			return code
+		}},
+		{name: "nonce of another login", tamper: func(code mockCode) mockCode {
+			code.nonce = "another nonce"
+			return code
+		}},
+		{name: "unknown state", state: func(state string) string { return state + "0" }},
+		{name: "callback from another browser", bind: func(binding string) string { return "" }},
+		{name: "binding of another login", bind: func(binding string) string { return binding + "0" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authURL, binding, err := o.AuthURL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, state := provider.authorize(authURL, claims)
+			if test.tamper != nil {
+				provider.mutex.Lock()
+				provider.codes[code] = test.tamper(provider.codes[code])
+				provider.mutex.Unlock()
+			}
+			if test.state != nil {
+				state = test.state(state)
+			}
+			if test.bind != nil {
+				binding = test.bind(binding)
+			}
+			if username, _, err := o.Exchange(code, state, binding); err == nil {
+				t.Errorf("login accepted for %s", username)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDC(t, provider)
+	login := func() error {
+		authURL, binding, err := o.AuthURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := provider.authorize(authURL, jwt.MapClaims{"preferred_username": "alice", "groups": "devs"})
+		_, _, err = o.Exchange(code, state, binding)
+		return err
+	}
+	if err := login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(); err != nil || provider.jwksCalls != 1 {
+		t.Fatalf("got error %v and %d key set fetches, want the cached key", err, provider.jwksCalls)
+	}
+	provider.rotate("key-2")
+	//Unknown keys can't make docker-ci fetch the key set more than once per jwksMinRefresh
+	if err := login(); err == nil || provider.jwksCalls != 1 {
+		t.Fatalf("got error %v and %d key set fetches right after the rotation", err, provider.jwksCalls)
+	}
+	o.mutex.Lock()
+	o.keysFetchedAt = time.Now().Add(-jwksMinRefresh)
+	o.mutex.Unlock()
+	if err := login(); err != nil || provider.jwksCalls != 2 {
+		t.Fatalf("got error %v and %d key set fetches after the rotation, want the new key", err, provider.jwksCalls)
+	}
+}
+
+func TestOIDCSlowKeySetFetch(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.fetching, provider.slowKeys = make(chan struct{}, 1), make(chan struct{})
+	o := newTestOIDC(t, provider)
+	logins := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		authURL, binding, err := o.AuthURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := provider.authorize(authURL, jwt.MapClaims{"preferred_username": "alice", "groups": "devs"})
+		go func() {
+			_, _, err := o.Exchange(code, state, binding)
+			logins <- err
+		}()
+	}
+	<-provider.fetching
+	//The logins started while the key set is fetched are not blocked
+	started := make(chan error, 1)
+	go func() {
+		_, _, err := o.AuthURL()
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		close(provider.slowKeys)
+		t.Fatal("AuthURL blocked by the key set fetch")
+	}
+	close(provider.slowKeys)
+	for i := 0; i < 2; i++ {
+		if err := <-logins; err != nil {
+			t.Error(err)
+		}
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.jwksCalls != 1 {
+		t.Errorf("got %d key set fetches for concurrent logins, want 1", provider.jwksCalls)
+	}
+}
+
+func TestOIDCRoleMapping(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDC(t, provider)
+	tests := []struct {
+		name      string
+		roleClaim string
+		defRole   users.Role
+		claims    jwt.MapClaims
+		role      users.Role
+		err       bool
+	}{
+		{"single value", "groups", "", jwt.MapClaims{"groups": "devs"}, users.RoleDeployer, false},
+		{"highest role kept", "groups", "", jwt.MapClaims{"groups": []interface{}{"devs", "ci-admins", "other"}}, users.RoleAdmin, false},
+		{"nested claim", "realm_access.roles", "", jwt.MapClaims{"realm_access": map[string]interface{}{"roles": []interface{}{"devs"}}}, users.RoleDeployer, false},
+		{"default role", "groups", users.RoleViewer, jwt.MapClaims{"groups": []interface{}{"other"}}, users.RoleViewer, false},
+		{"mapped role above the default", "groups", users.RoleViewer, jwt.MapClaims{"groups": "ci-admins"}, users.RoleAdmin, false},
+		{"no mapped role", "groups", "", jwt.MapClaims{"groups": []interface{}{"other"}}, "", true},
+		{"missing claim", "groups", "", jwt.MapClaims{}, "", true},
+		{"no username", "groups", "", jwt.MapClaims{"preferred_username": "", "groups": "devs"}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o.config.roleClaim, o.config.defaultRole = test.roleClaim, test.defRole
+			claims := jwt.MapClaims{"preferred_username": "alice"}
+			for name, value := range test.claims {
+				claims[name] = value
+			}
+			_, role, err := o.identity(claims)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error: %v", err, test.err)
+			}
+			if role != test.role {
+				t.Errorf("got role %q, want %q", role, test.role)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackNeedsStateCookie(t *testing.T) {
+	t.Setenv("PRIVATE_KEY", "0123456789abcdef0123456789abcdef")
+	provider := newMockProvider(t)
+	dir := t.TempDir()
+	userStore, err := users.Open(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{oidc: newTestOIDC(t, provider), users: userStore, audit: auditLog, network: newNetwork()}
+	start := func() (*http.Cookie, string, string) {
+		res := httptest.NewRecorder()
+		server.oidcLogin(res, httptest.NewRequest("GET", "/api/auth/oidc", nil))
+		cookies := res.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || !cookies[0].Secure {
+			t.Fatalf("got cookies %v, want a secure http only lax state cookie", cookies)
+		}
+		code, state := provider.authorize(res.Header().Get("Location"), jwt.MapClaims{"preferred_username": "alice", "groups": "devs"})
+		return cookies[0], code, state
+	}
+	callback := func(cookie *http.Cookie, code string, state string) string {
+		req := httptest.NewRequest("GET", "/api/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		server.oidcCallback(res, req)
+		return res.Header().Get("Location")
+	}
+
+	//The victim follows the callback url of a login started by the attacker
+	_, code, state := start()
+	if location := callback(nil, code, state); !strings.Contains(location, "error=") {
+		t.Errorf("callback without state cookie redirected to %s", location)
+	}
+	cookie, code, state := start()
+	if location := callback(cookie, code, state); !strings.Contains(location, "token=") {
+		t.Errorf("callback with state cookie redirected to %s", location)
+	}
+	if _, ok := userStore.Get("alice"); !ok {
+		t.Error("user not provisioned")
+	}
+}
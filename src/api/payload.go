@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"dockerci/src/docker"
+)
+
+//Subset of the push payload sent by Github, Gitea and Gitlab
+type pushPayload struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSha string `json:"checkout_sha"`
+	Repository  struct {
+		CloneUrl   string `json:"clone_url"`
+		GitHttpUrl string `json:"git_http_url"`
+	} `json:"repository"`
+}
+
+//Parse the push event from a webhook request body
+//The body is restored so that it can be read again
+//It returns nil if the request doesn't carry a push payload
+func parsePushEvent(req *http.Request) *docker.PushEvent {
+	if req.Body == nil || req.Method != http.MethodPost {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) == 0 {
+		return nil
+	}
+	//Github can send the payload as a form value
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		body = []byte(values.Get("payload"))
+	}
+	var payload pushPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Ref == "" {
+		return nil
+	}
+	push := &docker.PushEvent{
+		Ref:      payload.Ref,
+		Branch:   strings.TrimPrefix(payload.Ref, "refs/heads/"),
+		CloneUrl: payload.Repository.CloneUrl,
+		Sha:      payload.After,
+	}
+	if push.Branch == payload.Ref {
+		push.Branch = ""
+	}
+	if push.CloneUrl == "" {
+		push.CloneUrl = payload.Repository.GitHttpUrl
+	}
+	if payload.CheckoutSha != "" {
+		push.Sha = payload.CheckoutSha
+	}
+	return push
+}
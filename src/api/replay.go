@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	replayCacheSize = 10000          //Maximum number of delivery ids remembered
+	replayTTL       = 24 * time.Hour //Time after which a delivery id is forgotten
+)
+
+//Header with the time at which a hook call was sent, in unix seconds or RFC 3339
+//It is part of the signed payload of the signed calls, see signedWith
+const timestampHeader = "X-Docker-Ci-Timestamp"
+
+//Time at which a delivery id was received and the slot of the ring where it is stored
+type delivery struct {
+	at   time.Time
+	slot int
+}
+
+//Bounded cache of the webhook delivery ids already received, the oldest ids are evicted first
+type replayCache struct {
+	mutex sync.Mutex
+	seen  map[string]delivery
+	ring  []string
+	next  int
+}
+
+func newReplayCache(size int) *replayCache {
+	return &replayCache{seen: make(map[string]delivery), ring: make([]string, size)}
+}
+
+//Remember a delivery id, false is returned if it has already been received
+func (cache *replayCache) add(id string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if seen, ok := cache.seen[id]; ok {
+		if now.Sub(seen.at) < replayTTL {
+			return false
+		}
+		//The expired id moves to a new slot
+		cache.ring[seen.slot] = ""
+	}
+	if evicted := cache.ring[cache.next]; evicted != "" {
+		delete(cache.seen, evicted)
+	}
+	cache.ring[cache.next] = id
+	cache.seen[id] = delivery{at: now, slot: cache.next}
+	cache.next = (cache.next + 1) % len(cache.ring)
+	return true
+}
+
+//Forget a delivery id so that the delivery can be sent again
+//Its slot is freed so that the id is not evicted once it has been received again
+func (cache *replayCache) forget(id string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if seen, ok := cache.seen[id]; ok {
+		cache.ring[seen.slot] = ""
+		delete(cache.seen, id)
+	}
+}
+
+//Reject the replayed deliveries and the calls sent out of the HOOK_MAX_AGE window
+//The status and the reason are returned if the call is rejected, the status is 0 otherwise
+func (s *Server) checkReplay(req *http.Request) (int, string) {
+	if timestamp := req.Header.Get(timestampHeader); timestamp != "" {
+		sentAt, err := parseTimestamp(timestamp)
+		if err != nil {
+			return http.StatusBadRequest, "invalid timestamp"
+		}
+		if age := time.Since(sentAt); age > hookMaxAge() || age < -hookMaxAge() {
+			return http.StatusBadRequest, fmt.Sprintf("timestamp is out of the %s window", hookMaxAge())
+		}
+	}
+	if id := deliveryId(req); id != "" && !s.deliveries.add(id) {
+		return http.StatusConflict, "delivery already received"
+	}
+	return 0, ""
+}
+
+//Get the maximum age of a timestamped hook call from the HOOK_MAX_AGE env var (5m by default)
+func hookMaxAge() time.Duration {
+	if maxAge, err := time.ParseDuration(os.Getenv("HOOK_MAX_AGE")); err == nil && maxAge > 0 {
+		return maxAge
+	}
+	return 5 * time.Minute
+}
+
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, timestamp)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	cache := newReplayCache(3)
+	if !cache.add("a") || cache.add("a") {
+		t.Fatal("delivery a not remembered")
+	}
+	//A failed delivery sent again takes a new slot
+	cache.forget("a")
+	if !cache.add("a") {
+		t.Fatal("forgotten delivery refused")
+	}
+	//The former slot of a is reused without evicting it
+	if !cache.add("b") || !cache.add("c") {
+		t.Fatal("new deliveries refused")
+	}
+	if cache.add("a") {
+		t.Error("delivery a evicted by its former slot")
+	}
+	//The oldest delivery is evicted
+	if !cache.add("d") || !cache.add("a") {
+		t.Error("oldest delivery a not evicted")
+	}
+}
+
+func TestReplayTimestampWindow(t *testing.T) {
+	t.Setenv("HOOK_MAX_AGE", "5m")
+	now := time.Now()
+	tests := []struct {
+		name      string
+		timestamp string
+		status    int
+	}{
+		{"no timestamp", "", 0},
+		{"unix seconds", strconv.FormatInt(now.Unix(), 10), 0},
+		{"rfc 3339", now.Add(-time.Minute).Format(time.RFC3339), 0},
+		{"too old", strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10), 400},
+		{"in the future", now.Add(10 * time.Minute).Format(time.RFC3339), 400},
+		{"invalid", "yesterday", 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hooks/app", nil)
+			if test.timestamp != "" {
+				req.Header.Set(timestampHeader, test.timestamp)
+			}
+			if status, reason := (&Server{}).checkReplay(req); status != test.status {
+				t.Errorf("got status %d (%s), want %d", status, reason, test.status)
+			}
+		})
+	}
+}
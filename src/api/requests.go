@@ -1,37 +1,40 @@
 package api
 
 import (
-	"dockerci/src/docker"
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
+	"dockerci/src/users"
 	"dockerci/src/utils"
-	"log"
 	"net/http"
-	"os"
-	"strings"
-
-	"github.com/dgrijalva/jwt-go"
 )
 
+//Username of the admin user created from the PASSWORD env var
+const DefaultAdmin = "admin"
+
 type AuthRequest struct {
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
 
 func (s *Server) fetchHooks(res http.ResponseWriter, req *http.Request) {
-	var filteredContainers []docker.ContainerInfo
-	for _, container := range *s.containers {
-		hasName := true
-		for _, name := range container.Names {
-			if strings.TrimSpace(name) == "" {
-				hasName = false
-				break
-			}
-		}
-		if hasName && strings.TrimSpace(container.Id) != "" {
-			filteredContainers = append(filteredContainers, container)
-		}
-	}
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(200)
-	res.Write(utils.ToJSON(filteredContainers))
+	res.Write(utils.ToJSON(filterReadable(getPrincipal(req), s.containers.List())))
+}
+
+//Get the state of the connection with docker, the event bus statistics and the hook calls rejected by the allowlists
+func (s *Server) fetchStatus(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(map[string]interface{}{
+		"events":         s.docker.EventStreamState(),
+		"bus":            s.docker.Bus.Stats(),
+		"hookRejections": s.HookRejections(),
+		"repairs":        s.docker.LastRepairs(),
+	}))
 }
 func (s *Server) auth(res http.ResponseWriter, req *http.Request) {
 	var data AuthRequest
@@ -40,19 +43,70 @@ func (s *Server) auth(res http.ResponseWriter, req *http.Request) {
 		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
 		return
 	}
-	if data.Password != os.Getenv("PASSWORD") {
+	//The username is optional for the default admin user
+	if data.Username == "" {
+		data.Username = DefaultAdmin
+	}
+	user, ok := s.users.Authenticate(data.Username, data.Password)
+	entry := audit.Entry{Action: audit.ActionLogin, Actor: data.Username, Target: data.Username, Outcome: audit.Success}
+	if !ok {
+		entry.Outcome = audit.Failure
+	}
+	s.record(req, entry)
+	if !ok {
 		res.WriteHeader(401)
-		res.Write(utils.ToJSON(map[string]string{"error": "Invalid password"}))
+		res.Write(utils.ToJSON(map[string]string{"error": "Invalid username or password"}))
 		return
 	}
-	token := jwt.New(jwt.SigningMethodHS256)
-	auth, err := token.SignedString([]byte(os.Getenv("PRIVATE_KEY")))
+	s.sendTokens(res, user.Username)
+}
+
+//Exchange a refresh token for a new pair of tokens, the refresh token is revoked
+func (s *Server) refresh(res http.ResponseWriter, req *http.Request) {
+	var data RefreshRequest
+	if err := utils.FromJSON(req.Body, &data); err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	claims, err := middleware.VerifyToken(data.RefreshToken, middleware.RefreshToken)
+	if err == nil {
+		if _, exists := s.users.Get(claims.Username); !exists {
+			err = users.ErrNotFound
+		}
+	}
+	//Revoke fails if a concurrent refresh has already exchanged the token
+	if err != nil || !middleware.Revoke(claims) {
+		res.WriteHeader(401)
+		res.Write(utils.ToJSON(map[string]string{"error": "Invalid refresh token"}))
+		return
+	}
+	s.sendTokens(res, claims.Username)
+}
+
+//Revoke the access token of the request and the refresh token given in the body
+func (s *Server) logout(res http.ResponseWriter, req *http.Request) {
+	claims := middleware.GetClaims(req)
+	middleware.Revoke(claims)
+	s.record(req, audit.Entry{Action: audit.ActionLogout, Actor: claims.Username, Outcome: audit.Success})
+	var data RefreshRequest
+	if err := utils.FromJSON(req.Body, &data); err == nil && data.RefreshToken != "" {
+		if claims, err := middleware.VerifyToken(data.RefreshToken, middleware.RefreshToken); err == nil {
+			middleware.Revoke(claims)
+		}
+	}
+	res.WriteHeader(204)
+}
+
+func (s *Server) sendTokens(res http.ResponseWriter, username string) {
+	tokens, err := middleware.IssueTokens(username)
 	if err != nil {
-		log.Println(err)
+		apiLog.With("user", username).Errorf("Error while issuing tokens: %v", err)
 		res.WriteHeader(500)
 		res.Write(utils.ToJSON(map[string]string{"error": "Internal server error"}))
 		return
 	}
+	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(200)
-	res.Write(utils.ToJSON(map[string]string{"token": auth}))
+	res.Write(utils.ToJSON(tokens))
 }
@@ -1,42 +1,167 @@
 package api
 
 import (
-	"log"
+	"context"
 	"net/http"
 	"os"
+	"sync/atomic"
 
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
 	"dockerci/src/docker"
+	"dockerci/src/forge"
+	"dockerci/src/logger"
+	"dockerci/src/tracing"
+	"dockerci/src/users"
+	"dockerci/src/utils"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
+//Logger of the api entries
+var apiLog = logger.Default.With("component", "api")
+
 type Server struct {
 	router     *mux.Router
 	port       string
-	containers *[]docker.ContainerInfo
+	docker     *docker.DockerClient
+	containers *docker.Registry
+	users      *users.Store
+	keys       *users.KeyStore
+	audit      *audit.Log
+	forge      *forge.Store
+	oidc       *OIDC
+	deliveries *replayCache
+	network    *network
+	hooks      *hookStatuses
+	handlers   Handlers
+	http       *http.Server
+	draining   int32 //Set to 1 once the hooks are rejected for the shutdown
+}
+type RequestHandler func(ctx context.Context, name string, token string, push *docker.PushEvent, c *websocket.Conn) (int, string)
+type RepoRequestHandler func(ctx context.Context, token string, push *docker.PushEvent) (int, interface{})
+type ProjectRequestHandler func(ctx context.Context, project string, token string, push *docker.PushEvent) (int, interface{})
+type RollbackHandler func(ctx context.Context, name string) (int, string)
+
+//Handlers called when an update is requested, the context carries the span of the request
+type Handlers struct {
+	OnRequest        RequestHandler
+	OnRepoRequest    RepoRequestHandler
+	OnProjectRequest ProjectRequestHandler
+	OnRollback       RollbackHandler
 }
-type RequestHandler func(name string, token string, c *websocket.Conn) (int, string)
 
-func New(containers *[]docker.ContainerInfo, onRequest RequestHandler) *Server {
+func New(client *docker.DockerClient, containers *docker.Registry, userStore *users.Store, keyStore *users.KeyStore, auditLog *audit.Log, forgeStore *forge.Store, handlers Handlers) *Server {
 	port := os.Getenv("PORT")
 	router := mux.NewRouter()
-	server := &Server{router, port, containers}
+	server := &Server{
+		router:     router,
+		port:       port,
+		docker:     client,
+		containers: containers,
+		users:      userStore,
+		keys:       keyStore,
+		audit:      auditLog,
+		forge:      forgeStore,
+		oidc:       NewOIDC(),
+		deliveries: newReplayCache(replayCacheSize),
+		network:    newNetwork(),
+		hooks:      &hookStatuses{counts: make(map[int]uint64)},
+		handlers:   handlers,
+		http:       &http.Server{Addr: ":" + port, Handler: router},
+	}
 	router.Use(mux.CORSMethodMiddleware(router))
-	router.HandleFunc("/hooks/{name}", func(res http.ResponseWriter, req *http.Request) {
-		handleHook(res, req, onRequest)
-	}).Methods("GET")
+	router.HandleFunc("/healthz", server.healthz).Methods("GET")
+	router.HandleFunc("/readyz", server.readyz).Methods("GET")
+	hookGroup := router.PathPrefix("/hooks").Subrouter()
+	hookGroup.Use(tracing.Middleware)
+	//Counted before the rate limiter so that the rejected calls are counted too
+	hookGroup.Use(server.countHooks)
+	hookGroup.Use(server.rejectWhenDraining)
+	hookGroup.Use(middleware.NewRateLimiter("HOOK_RATE_LIMIT", 60).Middleware(server.clientIP))
+	//Registered before the named hook so that it takes precedence
+	hookGroup.HandleFunc("/repo", server.handleRepoHook).Methods("POST")
+	hookGroup.HandleFunc("/project/{project}", server.handleProjectHook).Methods("GET", "POST")
+	hookGroup.HandleFunc("/{name}", server.handleHook).Methods("GET", "POST")
+	//Authentication routes are registered before the protected api group
+	authGroup := router.PathPrefix("/api/auth").Subrouter()
+	authGroup.Use(middleware.NewRateLimiter("AUTH_RATE_LIMIT", 10).Middleware(server.clientIP))
+	authGroup.HandleFunc("", server.auth).Methods("POST")
+	authGroup.HandleFunc("/refresh", server.refresh).Methods("POST")
+	authGroup.Handle("/logout", middleware.AuthMiddleware(http.HandlerFunc(server.logout))).Methods("POST")
+	authGroup.HandleFunc("/providers", server.fetchAuthProviders).Methods("GET")
+	if server.oidc != nil {
+		authGroup.HandleFunc("/oidc", server.oidcLogin).Methods("GET")
+		authGroup.HandleFunc("/oidc/callback", server.oidcCallback).Methods("GET")
+	}
+	//The websocket is registered before the protected api group as it takes its token from the query
+	router.Handle("/api/events", middleware.WebsocketToken(server.authMiddleware(http.HandlerFunc(server.streamEvents)))).Methods("GET")
 	apiGroup := router.PathPrefix("/api").Subrouter()
+	apiGroup.Use(server.authMiddleware)
 	apiGroup.HandleFunc("/", server.fetchHooks).Methods("GET")
-	apiGroup.HandleFunc("/auth", server.auth).Methods("POST")
-
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./dist")))
+	apiGroup.HandleFunc("/status", server.fetchStatus).Methods("GET")
+	apiGroup.HandleFunc("/version", server.fetchVersion).Methods("GET")
+	apiGroup.Handle("/containers/{name}/deploy", server.rejectWhenDraining(http.HandlerFunc(server.deploy))).Methods("POST")
+	apiGroup.Handle("/containers/{name}/rollback", server.rejectWhenDraining(http.HandlerFunc(server.rollback))).Methods("POST")
+	apiGroup.HandleFunc("/me", server.fetchMe).Methods("GET")
+	apiGroup.HandleFunc("/jobs/{id}", server.fetchJob).Methods("GET")
+	apiGroup.HandleFunc("/jobs/{id}/log", server.fetchJobLog).Methods("GET")
+	keyGroup := apiGroup.PathPrefix("/keys").Subrouter()
+	keyGroup.Use(sessionMiddleware)
+	keyGroup.HandleFunc("", server.fetchKeys).Methods("GET")
+	keyGroup.HandleFunc("", server.createKey).Methods("POST")
+	keyGroup.HandleFunc("/{id}", server.revokeKey).Methods("DELETE")
+	adminGroup := apiGroup.PathPrefix("/users").Subrouter()
+	adminGroup.Use(adminMiddleware)
+	adminGroup.HandleFunc("", server.fetchUsers).Methods("GET")
+	adminGroup.HandleFunc("", server.createUser).Methods("POST")
+	adminGroup.HandleFunc("/{username}", server.updateUser).Methods("PUT")
+	adminGroup.HandleFunc("/{username}", server.deleteUser).Methods("DELETE")
+	auditGroup := apiGroup.PathPrefix("/audit").Subrouter()
+	auditGroup.Use(adminMiddleware)
+	auditGroup.HandleFunc("", server.fetchAudit).Methods("GET")
+	auditGroup.HandleFunc("/export", server.exportAudit).Methods("GET")
+	forgeGroup := apiGroup.PathPrefix("/forge/repositories").Subrouter()
+	forgeGroup.Use(adminMiddleware)
+	forgeGroup.HandleFunc("", server.fetchForgeRepositories).Methods("GET")
+	forgeGroup.HandleFunc("", server.setForgeRepository).Methods("PUT")
+	forgeGroup.HandleFunc("", server.deleteForgeRepository).Methods("DELETE")
 	return server
 }
 
 func (s *Server) Serve() {
-	log.Printf("Listening for requests at http://localhost:%s/hooks/", s.port)
-	if err := http.ListenAndServe(":"+s.port, s.router); err != nil {
-		log.Fatal(err)
+	//Registered last so that the routes added with Handle take precedence
+	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./dist")))
+	apiLog.Infof("Listening for requests at http://localhost:%s/hooks/", s.port)
+	if err := s.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		apiLog.Fatalf("%v", err)
 	}
 }
+
+//Reject the hooks and the deploys, the running updates are not affected
+func (s *Server) StopHooks() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+//Close the listener and wait for the end of the active requests
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+//Answer 503 to the update requests once the shutdown has started
+func (s *Server) rejectWhenDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if s.isDraining() {
+			res.Header().Set("Retry-After", "30")
+			res.WriteHeader(http.StatusServiceUnavailable)
+			res.Write(utils.ToJSON(map[string]string{"error": "docker-ci is shutting down"}))
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
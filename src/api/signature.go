@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"dockerci/src/docker"
+)
+
+//Label with the secret signing the webhooks of a container, WEBHOOK_SECRET is used if it is not set
+const webhookSecretLabel = "docker-ci.webhook-secret"
+
+//Check that a forge webhook is signed with the secret of every given container
+//Github and Gitea sign the body with HMAC-SHA-256 in X-Hub-Signature-256 (or X-Gitea-Signature), Gitlab sends the secret in X-Gitlab-Token
+//The body is restored so that it can be read again
+func verifyWebhook(req *http.Request, containers []docker.ContainerInfo) bool {
+	secrets := make([]string, 0, len(containers))
+	if len(containers) == 0 {
+		secrets = append(secrets, os.Getenv("WEBHOOK_SECRET"))
+	}
+	for _, container := range containers {
+		secret := container.Labels[webhookSecretLabel]
+		if secret == "" {
+			secret = os.Getenv("WEBHOOK_SECRET")
+		}
+		secrets = append(secrets, secret)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+	}
+	for _, secret := range secrets {
+		//A webhook can't be authenticated without secret
+		if secret == "" || !signedWith(req, body, secret) {
+			return false
+		}
+	}
+	return true
+}
+
+func signedWith(req *http.Request, body []byte, secret string) bool {
+	if token := req.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	signature := strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if signature == "" {
+		signature = req.Header.Get("X-Gitea-Signature")
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signedPayload(req, body))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+//Get the payload covered by the signature, "<timestamp>.<body>" if the call is timestamped, the body otherwise
+//A replayed call can't be given a new timestamp without the secret
+func signedPayload(req *http.Request, body []byte) []byte {
+	timestamp := req.Header.Get(timestampHeader)
+	if timestamp == "" {
+		return body
+	}
+	return append([]byte(timestamp+"."), body...)
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dockerci/src/docker"
+)
+
+const testBody = `{"ref":"refs/heads/master"}`
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func withSecret(name string, secret string) docker.ContainerInfo {
+	container := docker.ContainerInfo{Names: []string{"/" + name}, Labels: map[string]string{}}
+	if secret != "" {
+		container.Labels[webhookSecretLabel] = secret
+	}
+	return container
+}
+
+func TestAuthorizeUnauthenticatedHook(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "global")
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		containers []docker.ContainerInfo
+		status     int
+	}{
+		{"no signature", nil, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"token in the query only", nil, []docker.ContainerInfo{withSecret("app", "")}, 401},
+		{"github signature", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("secret", testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 200},
+		{"gitea signature", map[string]string{"X-Gitea-Signature": sign("secret", testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 200},
+		{"gitlab token", map[string]string{"X-Gitlab-Token": "secret"}, []docker.ContainerInfo{withSecret("app", "secret")}, 200},
+		{"wrong gitlab token", map[string]string{"X-Gitlab-Token": "global"}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"signed with another secret", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("global", testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"signature of another body", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("secret", "{}")}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"malformed signature", map[string]string{"X-Hub-Signature-256": "sha256=zz"}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"global secret", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("global", testBody)}, []docker.ContainerInfo{withSecret("app", "")}, 200},
+		{"unknown container", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("global", testBody)}, nil, 200},
+		{"group with one secret", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("secret", testBody)}, []docker.ContainerInfo{withSecret("api", "secret"), withSecret("worker", "secret")}, 200},
+		{"signed timestamp", map[string]string{"X-Docker-Ci-Timestamp": "1700000000", "X-Hub-Signature-256": "sha256=" + sign("secret", "1700000000."+testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 200},
+		{"unsigned timestamp", map[string]string{"X-Docker-Ci-Timestamp": "1700000000", "X-Hub-Signature-256": "sha256=" + sign("secret", testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"timestamp changed", map[string]string{"X-Docker-Ci-Timestamp": "1700000300", "X-Hub-Signature-256": "sha256=" + sign("secret", "1700000000."+testBody)}, []docker.ContainerInfo{withSecret("app", "secret")}, 401},
+		{"group with several secrets", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("secret", testBody)}, []docker.ContainerInfo{withSecret("api", "secret"), withSecret("worker", "")}, 401},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hooks/app?token=x", strings.NewReader(testBody))
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			principal, status := (&Server{}).authorizeHook(req, test.containers)
+			if status != test.status {
+				t.Errorf("got status %d, want %d", status, test.status)
+			}
+			if principal != nil {
+				t.Errorf("got principal %v for a forge webhook", principal)
+			}
+			if body, _ := ioutil.ReadAll(req.Body); string(body) != testBody {
+				t.Errorf("body not restored, got %q", body)
+			}
+		})
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "")
+	req := httptest.NewRequest("POST", "/hooks/app", strings.NewReader(testBody))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+sign("", testBody))
+	if _, status := (&Server{}).authorizeHook(req, []docker.ContainerInfo{withSecret("app", "")}); status != http.StatusUnauthorized {
+		t.Errorf("got status %d for a container without secret, want 401", status)
+	}
+}
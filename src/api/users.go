@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
+	"dockerci/src/docker"
+	"dockerci/src/users"
+	"dockerci/src/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type userKey struct{}
+type principalKey struct{}
+
+type UserRequest struct {
+	users.User
+	Password string `json:"password"`
+}
+
+type DeployRequest struct {
+	Token string `json:"token"`
+}
+
+//Authenticate a request with an access token or an api key
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	userAuth := middleware.AuthMiddleware(s.userMiddleware(next))
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token, _ := middleware.BearerToken(req)
+		if !users.IsKeyToken(token) {
+			userAuth.ServeHTTP(res, req)
+			return
+		}
+		principal, ok := s.authenticateKey(token)
+		if !ok {
+			res.WriteHeader(http.StatusUnauthorized)
+			res.Write([]byte("Unauthorized"))
+			return
+		}
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), principalKey{}, principal)))
+	})
+}
+
+//Load the user of the authenticated request, the user may have been deleted since the token was issued
+func (s *Server) userMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		user, ok := s.users.Get(middleware.GetClaims(req).Username)
+		if !ok {
+			res.WriteHeader(http.StatusUnauthorized)
+			res.Write([]byte("Unauthorized"))
+			return
+		}
+		ctx := context.WithValue(req.Context(), userKey{}, &user)
+		next.ServeHTTP(res, req.WithContext(context.WithValue(ctx, principalKey{}, &user)))
+	})
+}
+
+//Only allow users, api keys can't manage users and keys
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if getUser(req) == nil {
+			res.WriteHeader(http.StatusForbidden)
+			res.Write(utils.ToJSON(map[string]string{"error": "Forbidden"}))
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+//Only allow admins
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if user := getUser(req); user == nil || user.Role != users.RoleAdmin {
+			res.WriteHeader(http.StatusForbidden)
+			res.Write(utils.ToJSON(map[string]string{"error": "Forbidden"}))
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+//Get the api key of a token with its owner, the key is refused if its owner doesn't exist anymore
+func (s *Server) authenticateKey(token string) (*users.KeyPrincipal, bool) {
+	key, ok := s.keys.Authenticate(token)
+	if !ok {
+		return nil, false
+	}
+	owner, ok := s.users.Get(key.Owner)
+	if !ok {
+		return nil, false
+	}
+	return &users.KeyPrincipal{Key: key, Owner: owner}, true
+}
+
+//Get the user of an authenticated request, nil if it is authenticated with an api key
+func getUser(req *http.Request) *users.User {
+	user, _ := req.Context().Value(userKey{}).(*users.User)
+	return user
+}
+
+//Get the user or the api key of an authenticated request
+func getPrincipal(req *http.Request) users.Principal {
+	principal, _ := req.Context().Value(principalKey{}).(users.Principal)
+	return principal
+}
+
+//Keep the containers the user or the api key can read
+func filterReadable(principal users.Principal, containers []docker.ContainerInfo) []docker.ContainerInfo {
+	readable := make([]docker.ContainerInfo, 0, len(containers))
+	for _, container := range containers {
+		if principal.Can(users.ActionRead, &container) {
+			readable = append(readable, container)
+		}
+	}
+	return readable
+}
+
+//Trigger the update of a container from the dashboard
+func (s *Server) deploy(res http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	container, ok := s.containers.GetByName(name)
+	if !ok {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": "Container not found"}))
+		return
+	}
+	if !getPrincipal(req).Can(users.ActionTrigger, &container) {
+		res.WriteHeader(403)
+		res.Write(utils.ToJSON(map[string]string{"error": "Forbidden"}))
+		return
+	}
+	var data DeployRequest
+	utils.FromJSON(req.Body, &data)
+	status, msg := s.handlers.OnRequest(req.Context(), name, data.Token, nil, nil)
+	s.record(req, audit.Entry{Action: audit.ActionDeploy, Target: name, Outcome: outcomeOf(status), Status: status, Details: map[string]string{"message": msg}})
+	res.WriteHeader(status)
+	res.Write(utils.ToJSON(map[string]string{"message": msg}))
+}
+
+//Recreate a container with the image it was using before its last update
+func (s *Server) rollback(res http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	container, ok := s.containers.GetByName(name)
+	if !ok {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": "Container not found"}))
+		return
+	}
+	if !getPrincipal(req).Can(users.ActionRollback, &container) {
+		res.WriteHeader(403)
+		res.Write(utils.ToJSON(map[string]string{"error": "Forbidden"}))
+		return
+	}
+	status, msg := s.handlers.OnRollback(req.Context(), name)
+	s.record(req, audit.Entry{Action: audit.ActionRollback, Target: name, Outcome: outcomeOf(status), Status: status, Details: map[string]string{"message": msg}})
+	res.WriteHeader(status)
+	res.Write(utils.ToJSON(map[string]string{"message": msg}))
+}
+
+func (s *Server) fetchMe(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(getPrincipal(req)))
+}
+
+func (s *Server) fetchUsers(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(s.users.List()))
+}
+
+func (s *Server) createUser(res http.ResponseWriter, req *http.Request) {
+	var data UserRequest
+	if err := utils.FromJSON(req.Body, &data); err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	err := s.users.Create(data.User, data.Password)
+	s.recordUserChange(req, audit.ActionUserCreate, data, err)
+	if err == users.ErrExists {
+		res.WriteHeader(409)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	} else if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.WriteHeader(201)
+	res.Write(utils.ToJSON(data.User))
+}
+
+func (s *Server) updateUser(res http.ResponseWriter, req *http.Request) {
+	var data UserRequest
+	if err := utils.FromJSON(req.Body, &data); err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	data.Username = mux.Vars(req)["username"]
+	err := s.users.Update(data.User, data.Password)
+	s.recordUserChange(req, audit.ActionUserUpdate, data, err)
+	if err == users.ErrNotFound {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	} else if err != nil {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	res.WriteHeader(200)
+	res.Write(utils.ToJSON(data.User))
+}
+
+func (s *Server) deleteUser(res http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+	if username == getUser(req).Username {
+		res.WriteHeader(400)
+		res.Write(utils.ToJSON(map[string]string{"error": "You can't delete yourself"}))
+		return
+	}
+	err := s.users.Delete(username)
+	s.recordUserChange(req, audit.ActionUserDelete, UserRequest{User: users.User{Username: username}}, err)
+	if err == users.ErrNotFound {
+		res.WriteHeader(404)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write(utils.ToJSON(map[string]string{"error": err.Error()}))
+		return
+	}
+	//The keys are already unusable without their owner, they are removed so that a new user with the same name can't use them
+	if err := s.keys.RevokeOwner(username); err != nil {
+		apiLog.With("user", username).Errorf("Error while revoking api keys: %v", err)
+	}
+	res.WriteHeader(204)
+}
+
+//Record a user change in the audit log, the password is never recorded
+func (s *Server) recordUserChange(req *http.Request, action string, data UserRequest, err error) {
+	entry := audit.Entry{Action: action, Target: data.Username, Outcome: audit.Success}
+	if action != audit.ActionUserDelete {
+		entry.Details = map[string]string{"role": string(data.Role), "passwordChanged": strconv.FormatBool(data.Password != "")}
+	}
+	if err != nil {
+		entry.Outcome = audit.Failure
+		entry.Details = map[string]string{"error": err.Error()}
+	}
+	s.record(req, entry)
+}
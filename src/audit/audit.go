@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+	Denied  Outcome = "denied"
+)
+
+const (
+	ActionLogin       = "login"
+	ActionLoginOIDC   = "login.oidc"
+	ActionLogout      = "logout"
+	ActionHook        = "hook"
+	ActionDeploy      = "deploy" //Manual trigger from the api
+	ActionRollback    = "rollback"
+	ActionUserCreate  = "user.create"
+	ActionUserUpdate  = "user.update"
+	ActionUserDelete  = "user.delete"
+	ActionKeyCreate   = "key.create"
+	ActionKeyRevoke   = "key.revoke"
+	ActionForgeSet    = "forge.set"
+	ActionForgeDelete = "forge.delete"
+)
+
+//Audit log entry
+type Entry struct {
+	Seq        uint64            `json:"seq"`
+	Time       time.Time         `json:"time"`
+	Action     string            `json:"action"`
+	Actor      string            `json:"actor,omitempty"` //Username, empty for anonymous webhooks
+	Key        string            `json:"key,omitempty"`   //Api key id when the actor used a key
+	SourceIP   string            `json:"sourceIp,omitempty"`
+	Target     string            `json:"target,omitempty"` //Container, project, repository, user or key concerned
+	DeliveryId string            `json:"deliveryId,omitempty"`
+	Outcome    Outcome           `json:"outcome"`
+	Status     int               `json:"status,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+//Filter of the audit entries, empty fields match everything
+type Query struct {
+	Action  string
+	Actor   string
+	Target  string
+	Outcome Outcome
+	Since   time.Time
+	Until   time.Time
+	Limit   int //Maximum number of entries, the most recent ones are kept
+}
+
+//Append-only audit log stored as JSON Lines
+type Log struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+}
+
+//Open the audit log, the sequence continues from the last entry of the file
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	auditLog := &Log{path: path}
+	if err := auditLog.scan(func(entry Entry) bool {
+		auditLog.seq = entry.Seq
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	//A line truncated by a crash is terminated so that the next entry is not appended to it
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if reader, err := os.Open(path); err == nil {
+			reader.ReadAt(last, info.Size()-1)
+			reader.Close()
+		}
+		if last[0] != '\n' {
+			file.Write([]byte{'\n'})
+		}
+	}
+	auditLog.file = file
+	return auditLog, nil
+}
+
+//Append an entry to the log
+func (auditLog *Log) Record(entry Entry) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	auditLog.seq++
+	entry.Seq = auditLog.seq
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = auditLog.file.Write(append(data, '\n'))
+	return err
+}
+
+//Get the entries matching the query, the most recent first
+func (auditLog *Log) Query(query Query) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	err := auditLog.scan(func(entry Entry) bool {
+		if query.match(entry) {
+			entries = append(entries, entry)
+			//Only the most recent entries are kept in memory
+			if query.Limit > 0 && len(entries) > 2*query.Limit {
+				entries = append(entries[:0], entries[len(entries)-query.Limit:]...)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+//Write the entries matching the query as JSON Lines in chronological order, the limit is ignored
+func (auditLog *Log) Export(w io.Writer, query Query) error {
+	encoder := json.NewEncoder(w)
+	var err error
+	scanErr := auditLog.scan(func(entry Entry) bool {
+		if query.match(entry) {
+			err = encoder.Encode(entry)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return scanErr
+}
+
+//Call fn on each entry of the file until it returns false
+//Lines that can't be parsed (e.g: truncated by a crash) are skipped
+func (auditLog *Log) scan(fn func(entry Entry) bool) error {
+	file, err := os.Open(auditLog.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var entry Entry
+		if len(line) > 0 && json.Unmarshal(line, &entry) == nil {
+			if !fn(entry) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//Check if an entry matches the query
+func (query *Query) match(entry Entry) bool {
+	if query.Action != "" && entry.Action != query.Action {
+		return false
+	}
+	if query.Actor != "" && entry.Actor != query.Actor {
+		return false
+	}
+	if query.Target != "" && entry.Target != query.Target {
+		return false
+	}
+	if query.Outcome != "" && entry.Outcome != query.Outcome {
+		return false
+	}
+	if !query.Since.IsZero() && entry.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && entry.Time.After(query.Until) {
+		return false
+	}
+	return true
+}
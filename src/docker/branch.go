@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const defaultBranch = "master"
+
+//Get the branch encoded in a docker-ci.repo link (https://github.com/user/repo.git#branch[:context])
+//If no branch is given the default branch is returned
+func repoBranch(repo string) string {
+	i := strings.Index(repo, "#")
+	if i == -1 {
+		return defaultBranch
+	}
+	branch := repo[i+1:]
+	if j := strings.Index(branch, ":"); j != -1 {
+		branch = branch[:j]
+	}
+	if branch == "" {
+		return defaultBranch
+	}
+	return branch
+}
+
+//Get the branch patterns a container accepts pushes from
+//The docker-ci.branches label takes precedence over the branch of the docker-ci.repo label
+//A nil slice means that every push is accepted
+func branchPatterns(labels map[string]string) []string {
+	if branches := strings.TrimSpace(labels["docker-ci.branches"]); branches != "" {
+		patterns := make([]string, 0)
+		for _, pattern := range strings.Split(branches, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		return patterns
+	}
+	if repo := labels["docker-ci.repo"]; repo != "" {
+		return []string{repoBranch(repo)}
+	}
+	return nil
+}
+
+//Check if a push event should trigger an update of the container
+//If not, the reason is returned
+func (container *ContainerInfo) MatchPush(push *PushEvent) (bool, string) {
+	if push == nil || push.Ref == "" {
+		return true, ""
+	}
+	patterns := branchPatterns(container.Labels)
+	if patterns == nil {
+		return true, ""
+	}
+	if push.Branch == "" {
+		return false, fmt.Sprintf("ref %s is not a branch", push.Ref)
+	}
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, push.Branch); err == nil && ok {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("branch %s does not match %s", push.Branch, strings.Join(patterns, ","))
+}
@@ -0,0 +1,258 @@
+package docker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+type EventKind string
+
+const (
+	ContainerEventKind  EventKind = "container"  //Docker container events
+	ConnectionEventKind EventKind = "connection" //Docker event stream connection changes
+	RegistryEventKind   EventKind = "registry"   //Enabled containers added, removed or updated in the registry
+	JobEventKind        EventKind = "job"        //Docker-CI job events
+)
+
+const (
+	RegistryAdded   = "added"
+	RegistryRemoved = "removed"
+	RegistryUpdated = "updated"
+)
+
+const (
+	JobStarted  = "job.started"
+	JobProgress = "job.progress"
+	JobEnded    = "job.ended"
+)
+
+//Event published on the bus
+type Event struct {
+	Kind        EventKind       `json:"kind"`
+	Type        string          `json:"type"` //Container action (create, die...) or job event (job.started...)
+	ContainerId string          `json:"containerId,omitempty"`
+	Container   string          `json:"container,omitempty"`
+	Time        time.Time       `json:"time"`
+	Job         *Job            `json:"job,omitempty"`
+	Data        interface{}     `json:"data,omitempty"`
+	Message     *events.Message `json:"-"` //Raw docker event for container events
+}
+
+//Filter of the events delivered to a subscriber, empty fields match everything
+type Filter struct {
+	Kinds      []EventKind
+	Types      []string
+	Containers []string //Container ids or names
+}
+
+//Buffer size of the subscriptions that never drop an event
+const Lossless = -1
+
+//Subscription to the bus, events are received from C
+type Subscription struct {
+	C       <-chan Event
+	Name    string
+	ch      chan Event
+	bus     *Bus
+	filter  Filter
+	dropped uint64
+	//Queue of the lossless subscriptions, it is emptied into ch by the pump goroutine
+	mutex   sync.Mutex
+	pending []Event
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+//Delivery statistics of the bus
+type BusStats struct {
+	Published uint64            `json:"published"`
+	Dropped   uint64            `json:"dropped"`
+	Queued    map[string]int    `json:"queued"` //Subscriber name -> events waiting to be consumed
+	Drops     map[string]uint64 `json:"drops"`  //Subscriber name -> dropped events
+}
+
+//In-process pub/sub bus carrying docker events and docker-ci job events
+//Delivery never blocks the publisher, events are dropped if a subscriber buffer is full
+//The lossless subscriptions queue the events without limit instead, they are meant for the subscribers that keep a state from the events
+type Bus struct {
+	mutex       sync.RWMutex
+	subscribers map[*Subscription]bool
+	published   uint64
+	dropped     uint64
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*Subscription]bool)}
+}
+
+//Subscribe to the events matching the filter with a buffer of the given size
+//A Lossless buffer never drops an event, they are queued until the subscriber consumes them
+func (bus *Bus) Subscribe(name string, buffer int, filter Filter) *Subscription {
+	var sub *Subscription
+	if buffer == Lossless {
+		ch := make(chan Event)
+		sub = &Subscription{C: ch, Name: name, ch: ch, bus: bus, filter: filter, wake: make(chan struct{}, 1), done: make(chan struct{})}
+		go sub.pump()
+	} else {
+		ch := make(chan Event, buffer)
+		sub = &Subscription{C: ch, Name: name, ch: ch, bus: bus, filter: filter}
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subscribers[sub] = true
+	return sub
+}
+
+//Subscribe to the events matching the filter and call the handler for each of them in a dedicated goroutine
+func (bus *Bus) SubscribeFunc(name string, buffer int, filter Filter, handler func(event Event)) *Subscription {
+	sub := bus.Subscribe(name, buffer, filter)
+	go func() {
+		for event := range sub.C {
+			handler(event)
+		}
+	}()
+	return sub
+}
+
+//Publish an event to all the matching subscribers
+func (bus *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	atomic.AddUint64(&bus.published, 1)
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	for sub := range bus.subscribers {
+		if !sub.filter.match(event) {
+			continue
+		}
+		if sub.done != nil {
+			sub.enqueue(event)
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&bus.dropped, 1)
+		}
+	}
+}
+
+//Get the delivery statistics of the bus
+func (bus *Bus) Stats() BusStats {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	stats := BusStats{
+		Published: atomic.LoadUint64(&bus.published),
+		Dropped:   atomic.LoadUint64(&bus.dropped),
+		Queued:    make(map[string]int),
+		Drops:     make(map[string]uint64),
+	}
+	for sub := range bus.subscribers {
+		stats.Queued[sub.Name] += len(sub.ch) + sub.queued()
+		stats.Drops[sub.Name] += atomic.LoadUint64(&sub.dropped)
+	}
+	return stats
+}
+
+//Get the number of events dropped because the subscription buffer was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+//Unsubscribe from the bus and close the channel
+func (sub *Subscription) Close() {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+	if sub.bus.subscribers[sub] {
+		delete(sub.bus.subscribers, sub)
+		if sub.done != nil {
+			//The pump goroutine closes the channel
+			close(sub.done)
+		} else {
+			close(sub.ch)
+		}
+	}
+}
+
+//Queue an event of a lossless subscription and wake the pump goroutine up
+func (sub *Subscription) enqueue(event Event) {
+	sub.mutex.Lock()
+	sub.pending = append(sub.pending, event)
+	sub.mutex.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Get the number of events queued by a lossless subscription
+func (sub *Subscription) queued() int {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return len(sub.pending)
+}
+
+//Deliver the queued events of a lossless subscription in order until it is closed
+func (sub *Subscription) pump() {
+	defer close(sub.ch)
+	for {
+		select {
+		case <-sub.wake:
+		case <-sub.done:
+			return
+		}
+		for {
+			sub.mutex.Lock()
+			if len(sub.pending) == 0 {
+				sub.mutex.Unlock()
+				break
+			}
+			event := sub.pending[0]
+			sub.pending[0] = Event{}
+			sub.pending = sub.pending[1:]
+			sub.mutex.Unlock()
+			select {
+			case sub.ch <- event:
+			case <-sub.done:
+				return
+			}
+		}
+	}
+}
+
+//Check if an event matches the filter
+func (filter *Filter) match(event Event) bool {
+	if len(filter.Kinds) > 0 && !contains(filter.Kinds, event.Kind) {
+		return false
+	}
+	if len(filter.Types) > 0 && !containsString(filter.Types, event.Type) {
+		return false
+	}
+	if len(filter.Containers) > 0 && !containsString(filter.Containers, event.ContainerId) && !containsString(filter.Containers, event.Container) {
+		return false
+	}
+	return true
+}
+
+func contains(kinds []EventKind, kind EventKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLosslessSubscriptionKeepsEveryEvent(t *testing.T) {
+	bus := NewBus()
+	lossless := bus.Subscribe("registry", Lossless, Filter{Kinds: []EventKind{ContainerEventKind}})
+	buffered := bus.Subscribe("metrics", 1, Filter{Kinds: []EventKind{ContainerEventKind}})
+	for i := 0; i < 100; i++ {
+		bus.Publish(Event{Kind: ContainerEventKind, Type: string(Rename_container), ContainerId: string(rune('a' + i%26))})
+	}
+	if buffered.Dropped() != 99 {
+		t.Errorf("buffered subscription dropped %d events, want 99", buffered.Dropped())
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case event := <-lossless.C:
+			if want := string(rune('a' + i%26)); event.ContainerId != want {
+				t.Fatalf("event %d: got container %s, want %s", i, event.ContainerId, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	if lossless.Dropped() != 0 {
+		t.Errorf("lossless subscription dropped %d events", lossless.Dropped())
+	}
+	lossless.Close()
+	if _, ok := <-lossless.C; ok {
+		t.Error("channel still open after Close")
+	}
+}
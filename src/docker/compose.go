@@ -0,0 +1,186 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	composeProjectLabel   = "com.docker.compose.project"
+	composeServiceLabel   = "com.docker.compose.service"
+	composeDependsOnLabel = "com.docker.compose.depends_on"
+)
+
+//Get the compose project of the container, empty if it was not created by compose
+func (container *ContainerInfo) Project() string {
+	return container.Labels[composeProjectLabel]
+}
+
+//Get the compose services a container depends on
+//The label is a comma separated list of service[:condition[:restart]]
+func composeDependencies(labels map[string]string) []string {
+	dependencies := make([]string, 0)
+	for _, dependency := range strings.Split(labels[composeDependsOnLabel], ",") {
+		if service := strings.TrimSpace(strings.SplitN(dependency, ":", 2)[0]); service != "" {
+			dependencies = append(dependencies, service)
+		}
+	}
+	return dependencies
+}
+
+//Sort the containers of a project so that dependencies come before their dependents
+//Independent containers keep their docker-ci.order
+func sortServices(containers []ContainerInfo) ([]ContainerInfo, error) {
+	SortContainers(containers)
+	//Service name -> number of containers of this service not placed yet
+	remaining := make(map[string]int)
+	for _, container := range containers {
+		remaining[container.Labels[composeServiceLabel]]++
+	}
+	sorted := make([]ContainerInfo, 0, len(containers))
+	placed := make([]bool, len(containers))
+	for len(sorted) < len(containers) {
+		progress := false
+		for i, container := range containers {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, dependency := range composeDependencies(container.Labels) {
+				if remaining[dependency] > 0 {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[i], progress = true, true
+				remaining[container.Labels[composeServiceLabel]]--
+				sorted = append(sorted, container)
+				break
+			}
+		}
+		if !progress {
+			return nil, errors.New("dependency cycle between the services of the project")
+		}
+	}
+	return sorted, nil
+}
+
+//Get all the containers of a compose project
+func (docker *DockerClient) getProjectContainers(project string) ([]ContainerInfo, error) {
+	containers, err := docker.cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+project)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ContainerInfo, len(containers))
+	for i, container := range containers {
+		infos[i] = ContainerInfo{Names: container.Names, Id: container.ID, Image: container.Image, Labels: container.Labels}
+	}
+	return infos, nil
+}
+
+//Update the given enabled containers of a compose project
+//Dependents are stopped first, then dependencies are recreated first and dependents are brought back
+//Containers with the docker-ci.restart-on-dependency label are restarted if one of their upstream services was recreated
+func (docker *DockerClient) NewProjectRequest(ctx context.Context, project string, enabled []ContainerInfo, token string, push *PushEvent) ([]UpdateResult, error) {
+	projectContainers, err := docker.getProjectContainers(project)
+	if err != nil {
+		return nil, err
+	}
+	sorted, err := sortServices(projectContainers)
+	if err != nil {
+		return nil, err
+	}
+	enabledIds := make(map[string]bool)
+	for _, container := range enabled {
+		enabledIds[container.Id] = true
+	}
+	//Only enabled containers are updated, in dependency order
+	updated := make([]ContainerInfo, 0)
+	for _, container := range sorted {
+		if enabledIds[container.Id] {
+			updated = append(updated, container)
+		}
+	}
+	agents, results := docker.newAgents(ctx, updated, token, TriggerProject, push)
+	failed := updateImages(agents, results)
+	//Container id -> index of the agent that recreates it
+	recreated := make(map[string]int)
+	//Last safe point before the services are stopped, the whole project resumes after restart
+	draining := docker.Updates.Draining()
+	for i, agent := range agents {
+		if agent != nil && results[i].Status == "" {
+			if draining {
+				results[i].Status, results[i].Error = UpdateInterrupted, agent.interrupt().Error()
+				failed[agent.containerInfos.Config.Image] = true
+				continue
+			}
+			recreated[agent.containerId] = i
+		}
+	}
+	//Services that are recreated or restarted
+	changed := make(map[string]bool)
+	restarted := make(map[string]bool)
+	for _, container := range sorted {
+		service := container.Labels[composeServiceLabel]
+		if _, ok := recreated[container.Id]; ok {
+			changed[service] = true
+			continue
+		}
+		if container.Labels["docker-ci.restart-on-dependency"] != "true" {
+			continue
+		}
+		for _, dependency := range composeDependencies(container.Labels) {
+			if changed[dependency] {
+				restarted[container.Id], changed[service] = true, true
+				break
+			}
+		}
+	}
+	//Dependents are stopped first
+	duration, _ := time.ParseDuration("5s")
+	for i := len(sorted) - 1; i >= 0; i-- {
+		container := sorted[i]
+		if j, ok := recreated[container.Id]; ok {
+			//The error is logged by the agent, the container is stopped again when it is recreated
+			agents[j].stopContainer()
+		} else if restarted[container.Id] {
+			docker.journalRestart(container, StepStop)
+			if err := docker.cli.ContainerStop(ctx, container.Id, &duration); err != nil {
+				dockerLog.With("container", container.Name()).Errorf("Error while stopping container: %v", err)
+			}
+		}
+	}
+	//Dependencies are recreated first and dependents are brought back
+	for _, container := range sorted {
+		if i, ok := recreated[container.Id]; ok {
+			agent := agents[i]
+			if err := agent.recreateContainer(); err != nil {
+				results[i].Status, results[i].Error = UpdateFailed, err.Error()
+				failed[agent.containerInfos.Config.Image] = true
+			} else {
+				results[i].Status = UpdateUpdated
+			}
+		} else if restarted[container.Id] {
+			result := UpdateResult{Name: container.Name(), Status: UpdateRestarted}
+			if err := docker.cli.ContainerStart(ctx, container.Id, types.ContainerStartOptions{}); err != nil {
+				result.Status, result.Error = UpdateFailed, fmt.Sprintf("Error while restarting container: %v", err)
+			} else {
+				docker.journalRestart(container, "")
+			}
+			results = append(results, result)
+		}
+	}
+	removeFormerImages(agents, results, failed)
+	endJobs(agents, results)
+	return results, nil
+}
@@ -3,12 +3,14 @@ package docker
 import (
 	"bufio"
 	"context"
+	"dockerci/src/logger"
+	"dockerci/src/tracing"
 	"dockerci/src/utils"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
@@ -31,15 +33,23 @@ type ContainerAgent struct {
 	imageInfos     types.ImageInspect
 	ctx            context.Context
 	sock           *websocket.Conn
+	stopped        bool //The container has already been stopped before being recreated
+	updated        bool //The image has been updated and the container recreated
+	job            *Job
+	span           *tracing.Span      //Span of the job
+	log            *logger.Logger     //Logger with the container and job fields, it also writes to the job log file
+	logFile        *logger.JobLogFile //Log file of the job
 }
 
-func NewContainerAgent(docker *DockerClient, containerId string, name string, token string, sock *websocket.Conn) *ContainerAgent {
-	ctx := context.Background()
+//The docker calls of the agent are made with ctx so that they are traced as children of its span
+func NewContainerAgent(ctx context.Context, docker *DockerClient, containerId string, name string, token string, sock *websocket.Conn) (*ContainerAgent, error) {
 	containerInfos, err := docker.cli.ContainerInspect(ctx, containerId)
-	imageInfos, _, err1 := docker.cli.ImageInspectWithRaw(ctx, containerInfos.Image)
-	if err != nil || err1 != nil {
-		log.Println("Error while fetching container infos")
-		return nil
+	if err != nil {
+		return nil, &StepError{Container: name, Step: StepInspect, Message: "Error while fetching container infos", Err: err}
+	}
+	imageInfos, _, err := docker.cli.ImageInspectWithRaw(ctx, containerInfos.Image)
+	if err != nil {
+		return nil, &StepError{Container: name, Step: StepInspect, Message: "Error while fetching image infos", Err: err}
 	}
 	return &ContainerAgent{
 		docker:         docker,
@@ -51,35 +61,41 @@ func NewContainerAgent(docker *DockerClient, containerId string, name string, to
 		cli:            docker.cli,
 		sock:           sock,
 		token:          token,
-	}
+		log:            logger.Default.With("container", name),
+	}, nil
 }
 
 //This method will pull the container image, check if it is the same that the current
 //In case of a new one the container will be recreated and restarted
 //If the image has to be buit from a git repo it will build the image locally
-func (agent *ContainerAgent) UpdateContainer() (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			switch t := r.(type) {
-			case string:
-				err = errors.New(t)
-				agent.emit(Error, t)
-			case error:
-				err = t
-				agent.emit(Error, err.Error())
-			default:
-				err = errors.New("unknown panic")
-			}
-			agent.emit(Error, map[string]interface{}{"error": err.Error()})
-		}
-	}()
-	if err != nil {
-		agent.panic("Error while fetching container", err)
-	}
+func (agent *ContainerAgent) UpdateContainer() error {
 	agent.emit(Start, nil)
+	updated, err := agent.updateImage()
+	if err != nil || !updated {
+		return err
+	}
+	//Last safe point before the container is stopped, the update resumes after restart
+	if agent.docker.Updates.Draining() {
+		return agent.interrupt()
+	}
+	if err := agent.recreateContainer(); err != nil {
+		return err
+	}
+	agent.updated = true
+	if err := agent.removeFormerImage(); err != nil {
+		return err
+	}
+	agent.emit(End, nil)
+	return nil
+}
+
+//Build or pull the container image
+//It returns false if the image is already up to date
+func (agent *ContainerAgent) updateImage() (bool, error) {
 	if agent.isLocalImage() {
-		agent.print("Container is local image")
+		agent.log.Infof("Container is local image")
 		agent.emit(Build, nil)
+		agent.startPhase(PhaseBuild)
 		context := agent.getLabel("context")
 		if context == "" {
 			context = "."
@@ -91,85 +107,182 @@ func (agent *ContainerAgent) UpdateContainer() (err error) {
 		repo := agent.getLabel("repo")
 		status, err := agent.buildDockerImage(repo, dockerfile, agent.containerInfos.Config.Image, agent.getImageLabel("repo-sha"))
 		if err != nil {
-			agent.panic("Error while building image", err)
+			return false, err
 		}
+		agent.endPhase(nil)
 		agent.emit(BuildEnd, map[string]interface{}{"status": status})
-		if !status {
-			return nil
-		}
+		return status, nil
 	} else {
-		agent.print("Container is external image")
+		agent.log.Infof("Container is external image %s", agent.containerInfos.Config.Image)
 		agent.emit(Pull, nil)
+		agent.startPhase(PhasePull)
 		//Pulling Image
-		authToken := agent.getContainerCredsToken()
-		agent.print(agent.containerInfos.Config.Image)
+		authToken, err := agent.getContainerCredsToken()
+		if err != nil {
+			return false, agent.fail(StepCredentials, "Error while marshalling auth config", err)
+		}
 		status, err := agent.pullImage(agent.containerInfos.Config.Image, authToken, agent.imageInfos)
 		if err != nil {
-			agent.panic(err)
+			return false, agent.fail(StepPull, "Error while pulling image", err)
 		}
+		agent.endPhase(nil)
 		agent.emit(PullEnd, map[string]interface{}{"status": status})
-		if !status {
-			return nil
-		}
+		return status, nil
 	}
+}
 
-	//Stopping Container
+//Stop the container if it is running
+func (agent *ContainerAgent) stopContainer() error {
+	if agent.stopped {
+		return nil
+	}
 	agent.emit(Stop, nil)
+	agent.startPhase(PhaseStop)
 	if agent.containerInfos.State.Running {
+		if err := agent.journalStep(StepStop, agent.containerId); err != nil {
+			return agent.fail(StepStop, "Error while writing the update journal", err)
+		}
 		duration, _ := time.ParseDuration("5s")
-		if err = agent.cli.ContainerStop(agent.ctx, agent.containerId, &duration); err != nil {
-			agent.panic("Error while stopping container:", err)
+		if err := agent.cli.ContainerStop(agent.ctx, agent.containerId, &duration); err != nil {
+			//The container is left as it was, there is nothing to repair
+			agent.journalComplete()
+			return agent.fail(StepStop, "Error while stopping container", err)
 		}
 	}
+	agent.endPhase(nil)
+	agent.stopped = true
+	return nil
+}
+
+//Stop, remove and recreate the container with the same config and then start it
+func (agent *ContainerAgent) recreateContainer() error {
+	//Stopping Container
+	if err := agent.stopContainer(); err != nil {
+		return err
+	}
 	//Removing Container
 	agent.emit(Remove, nil)
-	agent.cli.ContainerRemove(agent.ctx, agent.containerId, types.ContainerRemoveOptions{
+	agent.startPhase(PhaseRecreate)
+	if err := agent.journalStep(StepRemove, agent.containerId); err != nil {
+		return agent.fail(StepRemove, "Error while writing the update journal", err)
+	}
+	if err := agent.cli.ContainerRemove(agent.ctx, agent.containerId, types.ContainerRemoveOptions{
 		RemoveVolumes: false, RemoveLinks: false, Force: true,
-	})
+	}); err != nil && !client.IsErrNotFound(err) {
+		return agent.fail(StepRemove, "Error while removing container", err)
+	}
 	//Recreating Container
 	agent.emit(Recreate, nil)
-	createdContainer, err := agent.cli.ContainerCreate(agent.ctx, agent.containerInfos.Config, agent.containerInfos.HostConfig, nil, nil, agent.containerInfos.Name)
+	if err := agent.journalStep(StepCreate, agent.containerId); err != nil {
+		return agent.fail(StepCreate, "Error while writing the update journal", err)
+	}
+	createdId, err := agent.docker.createFromSpec(agent.ctx, specOf(agent.containerInfos))
 	if err != nil {
-		agent.panic("Error while creating container:", err)
+		return agent.fail(StepCreate, "Error while creating container", err)
 	}
 	//Starting Container
 	agent.emit(Start, nil)
-	if err := agent.cli.ContainerStart(agent.ctx, createdContainer.ID, types.ContainerStartOptions{}); err != nil {
-		agent.panic("Error while starting container:", err)
+	agent.startPhase(PhaseStart)
+	if err := agent.journalStep(StepStart, createdId); err != nil {
+		agent.log.Warnf("Error while writing the update journal: %v", err)
 	}
+	if err := agent.cli.ContainerStart(agent.ctx, createdId, types.ContainerStartOptions{}); err != nil {
+		return agent.fail(StepStart, "Error while starting container", err)
+	}
+	agent.journalComplete()
+	agent.endPhase(nil)
+	return nil
+}
+
+//Keep the image the container was using before the update as its rollback image and remove all the untagged images
+//The image kept by the previous update loses its rollback tag and is removed with the untagged images
+func (agent *ContainerAgent) removeFormerImage() error {
 	//Removing former image
 	agent.emit(RemoveImage, nil)
-	if _, err := agent.cli.ImageRemove(agent.ctx, agent.imageInfos.ID, types.ImageRemoveOptions{Force: true}); err != nil {
-		agent.panic("Error while removing former image:", err)
+	agent.startPhase(PhaseRemoveImage)
+	if err := agent.cli.ImageTag(agent.ctx, agent.imageInfos.ID, rollbackTag(agent.containerName())); err != nil {
+		return agent.fail(StepRemoveImage, "Error while keeping former image", err)
 	}
 	filterArgs := filters.NewArgs(filters.KeyValuePair{Key: "dangling", Value: "true"})
 	//Remove all untagged image
-	if _, err = agent.cli.ImagesPrune(agent.ctx, filterArgs); err != nil {
-		agent.panic("Error while removing untagged image:", err)
+	if _, err := agent.cli.ImagesPrune(agent.ctx, filterArgs); err != nil {
+		return agent.fail(StepRemoveImage, "Error while removing untagged image", err)
 	}
+	agent.endPhase(nil)
+	return nil
+}
+
+//Recreate the container with the image it was using before its last update
+//The current image becomes the rollback image so that a rollback can be undone by another one
+func (agent *ContainerAgent) rollback() error {
+	agent.emit(Start, nil)
+	agent.startPhase(PhaseRollback)
+	tag := rollbackTag(agent.containerName())
+	former, _, err := agent.cli.ImageInspectWithRaw(agent.ctx, tag)
+	if client.IsErrNotFound(err) {
+		return agent.fail(StepRollback, "Error while fetching rollback image", ErrNoRollback)
+	} else if err != nil {
+		return agent.fail(StepRollback, "Error while fetching rollback image", err)
+	}
+	//Last safe point before the images are swapped
+	if agent.docker.Updates.Draining() {
+		agent.endPhase(nil)
+		return agent.interrupt()
+	}
+	if err := agent.cli.ImageTag(agent.ctx, agent.imageInfos.ID, tag); err != nil {
+		return agent.fail(StepRollback, "Error while keeping current image", err)
+	}
+	if err := agent.cli.ImageTag(agent.ctx, former.ID, agent.containerInfos.Config.Image); err != nil {
+		return agent.fail(StepRollback, "Error while restoring former image", err)
+	}
+	agent.endPhase(nil)
+	if err := agent.recreateContainer(); err != nil {
+		return err
+	}
+	agent.updated = true
 	agent.emit(End, nil)
-	return err
+	return nil
+}
+
+//Get the tag keeping the former image of a container
+func rollbackTag(name string) string {
+	return "docker-ci/rollback:" + name
+}
+
+//Fail the running step : the phase is ended, the error is logged and emitted
+//It returns the error as a StepError
+func (agent *ContainerAgent) fail(step string, message string, err error) error {
+	stepErr := &StepError{Container: agent.name, Step: step, Message: message, Err: err}
+	agent.endPhase(stepErr)
+	agent.log.Errorf("%v", stepErr)
+	agent.emit(Error, map[string]interface{}{"error": stepErr.Error()})
+	return stepErr
+}
+
+//Stop the update at a safe point because docker-ci is shutting down
+func (agent *ContainerAgent) interrupt() error {
+	agent.log.Warnf("Update interrupted by the shutdown, it resumes after restart")
+	return ErrShuttingDown
+}
+
+//Get the name of the container, it is kept when the container is recreated
+func (agent *ContainerAgent) containerName() string {
+	return strings.TrimPrefix(agent.containerInfos.Name, "/")
 }
 
 //Building Image from git repository
-func (agent *ContainerAgent) buildDockerImage(repoLink string, dockerfile string, image string, previousSha string) (status bool, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(r.(string))
-		}
-	}()
+func (agent *ContainerAgent) buildDockerImage(repoLink string, dockerfile string, image string, previousSha string) (bool, error) {
 	//We replace the {{TOKEN}} by the token
-	reg, err := regexp.Compile(`{{.+}}`)
-	if err != nil {
-		agent.panic("Error while compiling regexp:", err.Error())
-	}
-	remoteLink := reg.ReplaceAllString(repoLink, agent.token)
+	remoteLink := tokenPlaceholder.ReplaceAllString(repoLink, agent.token)
 	lastCommitSha, err := agent.getLastCommitSha(remoteLink)
 	if err != nil {
-		agent.panic("Error while getting last commit sha: ", err)
+		return false, agent.fail(StepResolve, "Error while getting last commit sha", err)
+	}
+	if agent.job != nil {
+		agent.job.Commit = lastCommitSha
 	}
 	if previousSha == lastCommitSha {
-		agent.print("Image already up to date, stopping process...")
+		agent.log.Infof("Image already up to date, stopping process...")
 		return false, nil
 	}
 	reader, err := agent.cli.ImageBuild(agent.ctx, nil, types.ImageBuildOptions{
@@ -182,15 +295,24 @@ func (agent *ContainerAgent) buildDockerImage(repoLink string, dockerfile string
 		Labels:        map[string]string{"docker-ci.repo-sha": lastCommitSha},
 	})
 	if err != nil {
-		agent.panic("while building image:", err)
+		return false, agent.fail(StepBuild, "Error while building image", err)
 	}
+	defer reader.Body.Close()
 	scanner := bufio.NewScanner(reader.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
 		agent.emit(BuildMessage, line)
+		agent.recordBuild(line)
+		agent.logOutput(line)
+		//The daemon reports a failed build step in the output, the stream itself ends normally
+		if err := outputError(line); err != nil {
+			return false, agent.fail(StepBuild, "Error while building image", err)
+		}
 	}
-	defer reader.Body.Close()
-	return true, err
+	if err := scanner.Err(); err != nil {
+		return false, agent.fail(StepBuild, "Error while reading build output", err)
+	}
+	return true, nil
 }
 
 //Pull an image from a container registry with optional credentials
@@ -199,41 +321,74 @@ func (agent *ContainerAgent) buildDockerImage(repoLink string, dockerfile string
 func (agent *ContainerAgent) pullImage(image string, authToken string, imageInfos types.ImageInspect) (status bool, err error) {
 	reader, err := agent.cli.ImagePull(agent.ctx, image, types.ImagePullOptions{All: false, RegistryAuth: authToken})
 	if err != nil {
-		return false, errors.New("Error while pulling image:" + err.Error())
+		return false, err
 	}
+	defer reader.Close()
 	scanner := bufio.NewScanner(reader)
-	regex, err := regexp.Compile(`\b(sha256:[A-Fa-f0-9]{64})\b`)
-	if err != nil {
-		return false, errors.New("Error while compiling regex: " + err.Error())
-	}
+	regex := regexp.MustCompile(`\b(sha256:[A-Fa-f0-9]{64})\b`)
 	//While pulling image we check if the image is new
 	//If not we stop the update process
 	for scanner.Scan() {
 		line := scanner.Text()
 		agent.emit(PullMessage, line)
+		agent.recordPull(line)
+		agent.logOutput(line)
 		if sha := regex.FindString(line); sha != "" {
-			agent.print("Pulling image with digest:", sha)
+			agent.log.Infof("Pulling image with digest: %s", sha)
+			if agent.job != nil {
+				agent.job.Digest = sha
+			}
 			for _, digest := range imageInfos.RepoDigests {
 				//We get the digest from the repo digest (name@digest)
 				if regex.FindString(digest) == sha {
-					agent.print("Image already up to date, stopping process...")
+					agent.log.Infof("Image already up to date, stopping process...")
 					return false, nil
 				}
 			}
 		}
 	}
-	defer reader.Close()
-	return true, err
+	return true, scanner.Err()
 }
 
-//Panic with container name
-func (agent *ContainerAgent) panic(args ...interface{}) {
-	log.Panicf("[%s] %v", agent.name, strings.Join(utils.InterfaceToStringSlice(args), " "))
+//Log a pull or build output line at the debug level, the pull progress lines are skipped
+func (agent *ContainerAgent) logOutput(line string) {
+	var msg struct {
+		pullMessage
+		buildMessage
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		agent.log.Debugf("%s", line)
+		return
+	}
+	switch {
+	case msg.Error != "":
+		agent.log.Warnf("%s", msg.Error)
+	case strings.TrimSpace(msg.Stream) != "":
+		agent.log.Debugf("%s", strings.TrimSpace(msg.Stream))
+	case msg.Status != "" && msg.ProgressDetail.Total == 0:
+		agent.log.Debugf("%s", strings.TrimSpace(msg.Id+" "+msg.Status))
+	}
 }
 
-//Print with container name
-func (agent *ContainerAgent) print(args ...interface{}) {
-	log.Printf("[%s] %v", agent.name, strings.Join(utils.InterfaceToStringSlice(args), " "))
+//Get the error reported by a pull or build output line, nil if it is not an error line
+func outputError(line string) error {
+	var msg struct {
+		Error       string `json:"error"`
+		ErrorDetail struct {
+			Message string `json:"message"`
+		} `json:"errorDetail"`
+	}
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		return nil
+	}
+	if msg.Error != "" {
+		return errors.New(msg.Error)
+	}
+	if msg.ErrorDetail.Message != "" {
+		return errors.New(msg.ErrorDetail.Message)
+	}
+	return nil
 }
 
 //Determine if the container image is local or external from the label
@@ -243,19 +398,18 @@ func (agent *ContainerAgent) isLocalImage() bool {
 }
 
 //Read auth config from container labels and return a base64 encoded string for docker.
-func (agent *ContainerAgent) getContainerCredsToken() string {
+func (agent *ContainerAgent) getContainerCredsToken() (string, error) {
 	serveraddress := agent.getLabel("auth-server")
 	password := agent.getLabel("password")
 	username := agent.getLabel("username")
 	if serveraddress != "" && username != "" && password != "" {
 		data, err := json.Marshal(DockerAuth{Username: username, Password: password, Serveraddress: serveraddress})
 		if err != nil {
-			agent.panic("Error while marshalling auth config:", err)
+			return "", err
 		}
-		auth := base64.StdEncoding.EncodeToString(data)
-		return string(auth)
+		return base64.StdEncoding.EncodeToString(data), nil
 	} else {
-		return ""
+		return "", nil
 	}
 }
 
@@ -263,10 +417,7 @@ func (agent *ContainerAgent) getContainerCredsToken() string {
 //Regexs : https://regexr.com/6b5f6,
 func (agent *ContainerAgent) getLastCommitSha(remote string) (string, error) {
 	//We find the from the remote url branch name
-	branch := strings.Replace(regexp.MustCompile(`#[A-Za-z]+`).FindString(remote), "#", "", -1)
-	if branch == "" {
-		branch = "master"
-	}
+	branch := repoBranch(remote)
 	//We get the last commit sha from the git protocol on the selected branch
 	remoteUrl := regexp.MustCompile(`(#\S+)|\.git`).ReplaceAllString(remote, "")
 	req, _ := http.NewRequest("GET", remoteUrl, nil)
@@ -276,17 +427,21 @@ func (agent *ContainerAgent) getLastCommitSha(remote string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
-	sha := strings.Split(regexp.MustCompile(`[0-9a-f]{5,50} refs/heads/`+branch).FindString(string(body)), " ")[0]
-	sha = sha[len(sha)-40:]
 	if err != nil {
 		return "", err
 	}
-	return sha, nil
+	sha := strings.Split(regexp.MustCompile(`[0-9a-f]{5,50} refs/heads/`+branch).FindString(string(body)), " ")[0]
+	if len(sha) < 40 {
+		return "", fmt.Errorf("%w: %s", ErrBranchNotFound, branch)
+	}
+	return sha[len(sha)-40:], nil
 }
 
-//Emit a message to the current socket
+//Emit a message to the current socket and publish the job progress
 func (agent *ContainerAgent) emit(event StreamEvent, data interface{}) {
+	agent.publishJob(JobProgress, map[string]interface{}{"event": event.String(), "data": data})
 	var dataStruct []byte
 	if agent.sock != nil {
 		switch t := data.(type) {
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dockerci/src/logger"
+
+	"github.com/docker/docker/client"
+)
+
+const testCommit = "0123456789abcdef0123456789abcdef01234567"
+
+//Docker client talking to a fake daemon
+func fakeDocker(t *testing.T, handler http.HandlerFunc) *DockerClient {
+	daemon := httptest.NewServer(handler)
+	t.Cleanup(daemon.Close)
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(daemon.URL, "http://")), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DockerClient{cli: cli, Bus: NewBus(), Updates: NewDebouncer()}
+}
+
+func testAgent(docker *DockerClient) *ContainerAgent {
+	return &ContainerAgent{docker: docker, cli: docker.cli, name: "app", ctx: context.Background(), log: logger.Default.With("container", "app")}
+}
+
+func TestBuildStopsOnErrorLines(t *testing.T) {
+	git := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("003f" + testCommit + " refs/heads/master\n"))
+	}))
+	defer git.Close()
+	tests := []struct {
+		name   string
+		output string
+		err    string
+	}{
+		{"success", `{"stream":"Step 1/2 : FROM alpine"}` + "\n" + `{"stream":"Successfully built 1a2b3c"}` + "\n", ""},
+		{"error", `{"stream":"Step 1/2 : RUN make"}` + "\n" + `{"errorDetail":{"code":2,"message":"make: *** No rule"},"error":"make: *** No rule"}` + "\n", "make: *** No rule"},
+		{"error detail only", `{"stream":"Step 1/2 : RUN make"}` + "\n" + `{"errorDetail":{"message":"no space left on device"}}` + "\n", "no space left on device"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := fakeDocker(t, func(w http.ResponseWriter, req *http.Request) {
+				if !strings.HasSuffix(req.URL.Path, "/build") {
+					t.Errorf("unexpected call to %s", req.URL.Path)
+					return
+				}
+				w.Write([]byte(test.output))
+			})
+			built, err := testAgent(docker).buildDockerImage(git.URL+"/app.git", "Dockerfile", "app:latest", "")
+			if test.err == "" {
+				if !built || err != nil {
+					t.Errorf("got %v %v, want the image built", built, err)
+				}
+				return
+			}
+			var stepErr *StepError
+			if built || !errors.As(err, &stepErr) || stepErr.Step != StepBuild || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v %v, want the build step failed with %q", built, err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Update waiting for the end of its debounce window or for the running update of its key
+type pendingUpdate struct {
+	fn       func() (int, interface{}) //Update of the most recent call
+	calls    int
+	done     chan struct{}
+	status   int
+	data     interface{}
+	deadline time.Time
+}
+
+//Coalesce the update calls of a key (container, repository, project)
+//Calls received during the debounce window or while an update of the key is running are merged into one queued update
+//The queued update runs the function of the most recent call and every merged call gets its result
+type Debouncer struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingUpdate //Key -> update waiting to start
+	locks   map[string]*keyLock       //Key -> lock held by the running update
+	running sync.WaitGroup            //Updates started and not ended yet
+	drain   chan struct{}             //Closed when the debouncer is drained
+	drained bool
+}
+
+//Lock of a key, removed once no update uses it
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewDebouncer() *Debouncer {
+	return &Debouncer{pending: make(map[string]*pendingUpdate), locks: make(map[string]*keyLock), drain: make(chan struct{})}
+}
+
+//Queue an update of a key and wait for its result
+//The number of calls merged into the update is returned with the result
+//Once the debouncer is drained the update is not run and ErrShuttingDown is returned with a 503 status
+func (debouncer *Debouncer) Do(key string, window time.Duration, fn func() (int, interface{})) (int, interface{}, int) {
+	debouncer.mutex.Lock()
+	if debouncer.drained {
+		debouncer.mutex.Unlock()
+		return 503, ErrShuttingDown, 1
+	}
+	update, ok := debouncer.pending[key]
+	if ok {
+		update.fn = fn
+		update.calls++
+	} else {
+		update = &pendingUpdate{fn: fn, calls: 1, done: make(chan struct{}), deadline: time.Now().Add(window)}
+		debouncer.pending[key] = update
+		go debouncer.run(key, update)
+	}
+	debouncer.mutex.Unlock()
+	<-update.done
+	return update.status, update.data, update.calls
+}
+
+//Run a function of a key once the running update of the key is done, the call is neither debounced nor coalesced
+//Once the debouncer is drained the function is not run and ErrShuttingDown is returned with a 503 status
+func (debouncer *Debouncer) Run(key string, fn func() (int, interface{})) (int, interface{}) {
+	lock := debouncer.acquire(key)
+	defer debouncer.release(key, lock)
+	debouncer.mutex.Lock()
+	drained := debouncer.drained
+	if !drained {
+		debouncer.running.Add(1)
+	}
+	debouncer.mutex.Unlock()
+	if drained {
+		return 503, ErrShuttingDown
+	}
+	defer debouncer.running.Done()
+	return fn()
+}
+
+//Get the number of updates waiting to start
+func (debouncer *Debouncer) Pending() int {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	return len(debouncer.pending)
+}
+
+//Stop running the queued updates and wait for the end of the running ones
+//The updates waiting for their window or for their key are ended with ErrShuttingDown
+//It returns the context error if the running updates are not over before its end
+func (debouncer *Debouncer) Drain(ctx context.Context) error {
+	debouncer.mutex.Lock()
+	if !debouncer.drained {
+		debouncer.drained = true
+		close(debouncer.drain)
+	}
+	debouncer.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		debouncer.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Check if the debouncer is drained, the running updates stop at their next safe point
+func (debouncer *Debouncer) Draining() bool {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	return debouncer.drained
+}
+
+//Run a pending update once its window is over and the previous update of its key is done
+func (debouncer *Debouncer) run(key string, update *pendingUpdate) {
+	select {
+	case <-time.After(time.Until(update.deadline)):
+	case <-debouncer.drain:
+	}
+	lock := debouncer.acquire(key)
+	//Calls received from now on are queued in a new update
+	debouncer.mutex.Lock()
+	delete(debouncer.pending, key)
+	fn, drained := update.fn, debouncer.drained
+	if !drained {
+		debouncer.running.Add(1)
+	}
+	debouncer.mutex.Unlock()
+	if drained {
+		update.status, update.data = 503, ErrShuttingDown
+	} else {
+		update.status, update.data = fn()
+		debouncer.running.Done()
+	}
+	debouncer.release(key, lock)
+	close(update.done)
+}
+
+func (debouncer *Debouncer) acquire(key string) *keyLock {
+	debouncer.mutex.Lock()
+	lock, ok := debouncer.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		debouncer.locks[key] = lock
+	}
+	lock.refs++
+	debouncer.mutex.Unlock()
+	lock.Lock()
+	return lock
+}
+
+func (debouncer *Debouncer) release(key string, lock *keyLock) {
+	lock.Unlock()
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	if lock.refs--; lock.refs == 0 {
+		delete(debouncer.locks, key)
+	}
+}
+
+//Get the debounce window of containers from the docker-ci.debounce label, HOOK_DEBOUNCE is used for containers without label
+//The longest window is used for a group of containers
+func DebounceWindow(containers ...ContainerInfo) time.Duration {
+	global, _ := time.ParseDuration(os.Getenv("HOOK_DEBOUNCE"))
+	if len(containers) == 0 {
+		return maxDuration(global, 0)
+	}
+	var window time.Duration
+	for _, container := range containers {
+		containerWindow := global
+		if label, err := time.ParseDuration(strings.TrimSpace(container.Labels["docker-ci.debounce"])); err == nil {
+			containerWindow = label
+		}
+		window = maxDuration(window, containerWindow)
+	}
+	return window
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
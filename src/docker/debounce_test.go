@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunWaitsForTheRunningUpdate(t *testing.T) {
+	debouncer := NewDebouncer()
+	started, release := make(chan struct{}), make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		debouncer.Do("app", 0, func() (int, interface{}) {
+			close(started)
+			<-release
+			close(updated)
+			return 200, "updated"
+		})
+	}()
+	<-started
+	result := make(chan interface{})
+	go func() {
+		_, data := debouncer.Run("app", func() (int, interface{}) {
+			select {
+			case <-updated:
+				return 200, "rolled back"
+			default:
+				return 500, "ran during the update"
+			}
+		})
+		result <- data
+	}()
+	//Another key is not blocked by the running update
+	if status, _ := debouncer.Run("worker", func() (int, interface{}) { return 200, nil }); status != 200 {
+		t.Fatalf("got status %d for another key", status)
+	}
+	select {
+	case data := <-result:
+		t.Fatalf("run before the end of the update: %v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if data := <-result; data != "rolled back" {
+		t.Errorf("got %v, want the run after the update", data)
+	}
+}
+
+func TestRunOnceDrained(t *testing.T) {
+	debouncer := NewDebouncer()
+	if err := debouncer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status, data := debouncer.Run("app", func() (int, interface{}) {
+		t.Error("function run once drained")
+		return 200, nil
+	})
+	if status != 503 || data != ErrShuttingDown {
+		t.Errorf("got %d %v, want 503 %v", status, data, ErrShuttingDown)
+	}
+}
@@ -43,8 +43,33 @@ const (
 // )
 
 type ContainerInfo struct {
-	Names []string
-	Id    string
+	Names   []string
+	Id      string
+	Image   string
+	Hook    string   //Name of the hook endpoint (docker-ci.name label or container name)
+	Aliases []string //Additional hook names (docker-ci.aliases label)
+	Error   string   `json:",omitempty"`
+	State   ContainerState
+	Labels  map[string]string `json:"-"`
+}
+
+// Runtime state of a container
+type ContainerState struct {
+	Status       string //created, running, restarting, exited...
+	Running      bool
+	ExitCode     int
+	Health       string `json:",omitempty"` //starting, healthy, unhealthy
+	RestartCount int
+	StartedAt    string
+	FinishedAt   string
+}
+
+//Push event extracted from a forge webhook payload (Github, Gitea, Gitlab)
+type PushEvent struct {
+	Ref      string //Full git ref (refs/heads/master, refs/tags/v1.0.0)
+	Branch   string //Branch name if the ref is a branch, empty otherwise
+	CloneUrl string
+	Sha      string
 }
 type DockerAuth struct {
 	Username      string `json:"username,omitempty"`
@@ -68,3 +93,15 @@ const (
 	Remove       StreamEvent = iota
 	End          StreamEvent = iota
 )
+
+var streamEventNames = [...]string{
+	"start", "pull", "pull-message", "pull-end", "build", "build-message", "build-end",
+	"stop", "recreate", "restart", "error", "remove-image", "remove", "end",
+}
+
+func (event StreamEvent) String() string {
+	if int(event) < len(streamEventNames) {
+		return streamEventNames[event]
+	}
+	return "unknown"
+}
@@ -2,9 +2,15 @@ package docker
 
 import (
 	"context"
-	"log"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"dockerci/src/logger"
+	"dockerci/src/tracing"
+	"dockerci/src/utils"
+
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
@@ -12,40 +18,118 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+//Logger of the docker client entries
+var dockerLog = logger.Default.With("component", "docker")
+
 type DockerClient struct {
 	cli             *client.Client
-	Events          map[ContainerEvent]func(event events.Message) //Map with container event in key and function in value
+	Bus             *Bus            //Bus on which docker events, connection changes and job events are published
+	Updates         *Debouncer      //Queue coalescing the update requests
+	Jobs            *JobHistory     //Last jobs and their logs
+	JobLogs         *logger.JobLogs //Log files of the last jobs of each container
+	Journal         *Journal        //Destructive steps of the running updates, set before the first update
 	containerAgents []*ContainerAgent
+	stream          eventStream
+	repairs         struct {
+		mutex sync.Mutex
+		last  []Repair
+	}
+	diskUsage struct {
+		mutex      sync.Mutex
+		buildCache int64
+		at         time.Time
+	}
 }
 
 func New() *DockerClient {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation(), withTracing())
 	if err != nil {
-		log.Fatal("Docker instance error:", err)
+		dockerLog.Fatalf("Docker instance error: %v", err)
 	}
-	version, err := cli.ServerVersion(context.Background())
-	if err != nil {
-		log.Fatal("Docker instance error:", err)
+	//docker-ci starts without docker, the readiness endpoint reports it until it is reachable
+	if version, err := cli.ServerVersion(context.Background()); err != nil {
+		dockerLog.Warnf("Error while connecting to docker, retrying in background: %v", err)
+	} else {
+		dockerLog.Infof("Connected to docker sock version: %s", version.Version)
+	}
+	bus := NewBus()
+	return &DockerClient{
+		cli:             cli,
+		Bus:             bus,
+		Updates:         NewDebouncer(),
+		Jobs:            NewJobHistory(bus),
+		JobLogs:         logger.OpenJobLogs(utils.DataPath("jobs")),
+		containerAgents: make([]*ContainerAgent, 0),
+	}
+}
+
+//Trace the docker api calls when tracing is enabled
+func withTracing() client.Opt {
+	return func(c *client.Client) error {
+		if !tracing.Enabled() {
+			return nil
+		}
+		httpClient := c.HTTPClient()
+		//The scheme is guessed from the transport type which is hidden by the wrapper
+		if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+			if err := client.WithScheme("https")(c); err != nil {
+				return err
+			}
+		}
+		httpClient.Transport = tracing.DockerTransport(httpClient.Transport)
+		return client.WithHTTPClient(httpClient)(c)
 	}
-	log.Println("Connected to docker sock version:", version.Version)
-	return &DockerClient{cli, make(map[ContainerEvent]func(event events.Message)), make([]*ContainerAgent, 0)}
 }
 
-//Listen to container events and call the function associated with the event
+//Listen to container events and publish them on the bus
+//If the stream is closed it reconnects with an exponential backoff
+//and resumes from the last seen event so that no event is lost
 func (docker *DockerClient) ListenToEvents() {
-	log.Printf("Listening for container %v", docker.mapKeys(docker.Events))
-	body, err := docker.cli.Events(context.Background(), types.EventsOptions{
+	dockerLog.Infof("Listening for container events")
+	backoff := minReconnectBackoff
+	for {
+		_, err := docker.cli.Ping(context.Background())
+		if err == nil {
+			connectedAt := time.Now()
+			err = docker.listen()
+			//The backoff is only reset if the stream was stable
+			if time.Since(connectedAt) > maxReconnectBackoff {
+				backoff = minReconnectBackoff
+			}
+		}
+		docker.setDisconnected(err)
+		dockerLog.Warnf("Docker event stream disconnected: %v, reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+//Open the event stream from the last seen event and dispatch the events until the stream is closed
+func (docker *DockerClient) listen() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, errs := docker.cli.Events(ctx, types.EventsOptions{
 		Filters: filters.NewArgs(filters.Arg("type", "container")),
+		Since:   docker.stream.since(),
 	})
+	docker.setConnected()
 	for {
 		select {
 		case msg := <-body:
-			//Get handler and if it exists and then check if msg type correspond to current event
-			if handler, ok := docker.Events[ContainerEvent(msg.Action)]; msg.Type == events.ContainerEventType && ok {
-				handler(msg)
+			if msg.Type != events.ContainerEventType || !docker.stream.seen(msg) {
+				continue
 			}
-		case err := <-err:
-			log.Fatal(err)
+			docker.Bus.Publish(Event{
+				Kind: ContainerEventKind,
+				//Some actions carry a status (health_status: healthy), only the event name is kept
+				Type:        strings.TrimSpace(strings.SplitN(msg.Action, ":", 2)[0]),
+				ContainerId: msg.Actor.ID,
+				Container:   msg.Actor.Attributes["name"],
+				Time:        time.Unix(0, msg.TimeNano),
+				Message:     &msg,
+			})
+		case err := <-errs:
+			return err
 		}
 	}
 }
@@ -59,40 +143,61 @@ func (docker *DockerClient) IsContainerEnabled(containerId string) bool {
 	return container.Config.Labels["docker-ci.enable"] == "true"
 }
 
-//Get a slice with all the container that have docker-ci enabled
-func (docker *DockerClient) GetContainersEnabled() []types.Container {
-
-	containers, err := docker.cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+// Create a new request and build a new container agent that will handle update
+func (docker *DockerClient) NewRequest(ctx context.Context, containerId string, name string, token string, push *PushEvent, sock *websocket.Conn) error {
+	containerAgent, err := NewContainerAgent(ctx, docker, containerId, name, token, sock)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	enabledContainers := make([]types.Container, 0)
-	for _, container := range containers {
-		if container.Labels["docker-ci.enable"] == "true" {
-			enabledContainers = append(enabledContainers, container)
-		}
+	containerAgent.startJob(TriggerHook, push)
+	err = containerAgent.UpdateContainer()
+	containerAgent.endJob(containerAgent.result(err))
+	if containerAgent.sock != nil {
+		containerAgent.sock.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
 	}
-	return enabledContainers
+	return err
 }
 
-// Create a new request and build a new container agent that will handle update
-func (docker *DockerClient) NewRequest(containerId string, name string, token string, sock *websocket.Conn) error {
-	containerAgent := NewContainerAgent(docker, containerId, name, token, sock)
-	err := containerAgent.UpdateContainer()
-	if containerAgent.sock != nil {
-		containerAgent.sock.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
+//Recreate a container with the image it was using before its last update
+//ErrNoRollback is returned if the container has not been updated by docker-ci
+func (docker *DockerClient) NewRollback(ctx context.Context, containerId string, name string) error {
+	containerAgent, err := NewContainerAgent(ctx, docker, containerId, name, "", nil)
+	if err != nil {
+		return err
 	}
+	containerAgent.startJob(TriggerRollback, nil)
+	err = containerAgent.rollback()
+	containerAgent.endJob(containerAgent.result(err))
+	return err
+}
+
+//Check that the docker daemon answers
+func (docker *DockerClient) Ping(ctx context.Context) error {
+	_, err := docker.cli.Ping(ctx)
 	return err
 }
 
-//Get the list of the listened events
-func (docker *DockerClient) mapKeys(m map[ContainerEvent]func(event events.Message)) []string {
-	keys := make([]string, len(m))
+//Get the docker api version used by the client, it is negotiated with the daemon on the first call
+func (docker *DockerClient) APIVersion() string {
+	return docker.cli.ClientVersion()
+}
 
-	i := 0
-	for k := range m {
-		keys[i] = string(k)
-		i++
+//Get the size of the build cache in bytes
+//The disk usage is slow to compute so the result is kept for a minute
+func (docker *DockerClient) BuildCacheSize() (int64, error) {
+	docker.diskUsage.mutex.Lock()
+	defer docker.diskUsage.mutex.Unlock()
+	if time.Since(docker.diskUsage.at) < time.Minute {
+		return docker.diskUsage.buildCache, nil
+	}
+	usage, err := docker.cli.DiskUsage(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, cache := range usage.BuildCache {
+		size += cache.Size
 	}
-	return keys
+	docker.diskUsage.buildCache, docker.diskUsage.at = size, time.Now()
+	return size, nil
 }
@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Steps of an update, they are set in the errors returned by the agents
+const (
+	StepInspect     = "inspect"
+	StepCredentials = "credentials"
+	StepResolve     = "resolve"
+	StepPull        = PhasePull
+	StepBuild       = PhaseBuild
+	StepStop        = PhaseStop
+	StepRemove      = "remove"
+	StepCreate      = "create"
+	StepStart       = PhaseStart
+	StepRemoveImage = PhaseRemoveImage
+	StepRollback    = PhaseRollback
+)
+
+var (
+	ErrBranchNotFound = errors.New("branch not found in the remote repository")
+	ErrShuttingDown   = errors.New("docker-ci is shutting down, the update resumes after restart")
+	ErrNoRollback     = errors.New("no former image to roll back to")
+)
+
+//Failure of an update step of a container
+//The cause can be checked with errors.Is and errors.As
+type StepError struct {
+	Container string
+	Step      string
+	Message   string //What the agent was doing, e.g: "Error while creating container"
+	Err       error
+}
+
+func (err *StepError) Error() string {
+	return fmt.Sprintf("%s: %v", err.Message, err.Err)
+}
+
+func (err *StepError) Unwrap() error {
+	return err.Err
+}
+
+//Get the step of an update error, empty if it is not a StepError
+func FailedStep(err error) string {
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		return stepErr.Step
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+//State of the docker event stream
+type EventStreamState struct {
+	Connected  bool      `json:"connected"`
+	Reconnects int       `json:"reconnects"` //Number of times the stream has been reopened
+	LastEvent  time.Time `json:"lastEvent"`
+	Since      time.Time `json:"since"` //Time of the last connection or disconnection
+	Error      string    `json:"error,omitempty"`
+}
+
+//Event stream bookkeeping used to resume the stream after a reconnection
+type eventStream struct {
+	mutex       sync.Mutex
+	state       EventStreamState
+	connections int
+	lastNano    int64
+	lastKey     string
+}
+
+//Get the since option to resume the stream from the last seen event
+func (stream *eventStream) since() string {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.lastNano == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%09d", stream.lastNano/int64(time.Second), stream.lastNano%int64(time.Second))
+}
+
+//Record an event and return false if it has already been seen before a reconnection
+func (stream *eventStream) seen(msg events.Message) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	key := msg.ID + msg.Action
+	if msg.TimeNano < stream.lastNano || (msg.TimeNano == stream.lastNano && key == stream.lastKey) {
+		return false
+	}
+	stream.lastNano, stream.lastKey = msg.TimeNano, key
+	stream.state.LastEvent = time.Unix(0, msg.TimeNano)
+	return true
+}
+
+//Get the current state of the docker event stream
+func (docker *DockerClient) EventStreamState() EventStreamState {
+	docker.stream.mutex.Lock()
+	defer docker.stream.mutex.Unlock()
+	return docker.stream.state
+}
+
+//Mark the event stream as connected and publish the change
+func (docker *DockerClient) setConnected() {
+	docker.stream.mutex.Lock()
+	if docker.stream.connections > 0 {
+		docker.stream.state.Reconnects++
+	}
+	docker.stream.connections++
+	docker.stream.state.Connected = true
+	docker.stream.state.Since = time.Now()
+	docker.stream.state.Error = ""
+	state := docker.stream.state
+	docker.stream.mutex.Unlock()
+	docker.Bus.Publish(Event{Kind: ConnectionEventKind, Type: "connected", Data: state})
+}
+
+//Mark the event stream as disconnected and publish the change if it was connected
+func (docker *DockerClient) setDisconnected(err error) {
+	docker.stream.mutex.Lock()
+	wasConnected := docker.stream.state.Connected
+	docker.stream.state.Connected = false
+	if err != nil {
+		docker.stream.state.Error = err.Error()
+	}
+	if wasConnected {
+		docker.stream.state.Since = time.Now()
+	}
+	state := docker.stream.state
+	docker.stream.mutex.Unlock()
+	if wasConnected {
+		docker.Bus.Publish(Event{Kind: ConnectionEventKind, Type: "disconnected", Data: state})
+	}
+}
+
+//Double the backoff up to the max reconnection backoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,124 @@
+package docker
+
+import (
+	"context"
+)
+
+const (
+	UpdateUpdated     = "updated"
+	UpdateUpToDate    = "up-to-date"
+	UpdateRestarted   = "restarted"
+	UpdateIgnored     = "ignored"
+	UpdateFailed      = "failed"
+	UpdateInterrupted = "interrupted" //Stopped at a safe point by the shutdown, the update resumes after restart
+)
+
+//Result of an update for one container of a repository or project request
+type UpdateResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+//Update all the given containers in order
+//Containers sharing the same image are grouped so that the image is built or pulled only once
+//Former images are kept for a rollback once every container of the group has been recreated
+func (docker *DockerClient) NewRepoRequest(ctx context.Context, containers []ContainerInfo, token string, push *PushEvent) []UpdateResult {
+	agents, results := docker.newAgents(ctx, containers, token, TriggerRepo, push)
+	failed := updateImages(agents, results)
+	for i, agent := range agents {
+		if agent == nil || results[i].Status != "" {
+			continue
+		}
+		if agent.docker.Updates.Draining() {
+			results[i].Status, results[i].Error = UpdateInterrupted, agent.interrupt().Error()
+			failed[agent.containerInfos.Config.Image] = true
+			continue
+		}
+		if err := agent.recreateContainer(); err != nil {
+			results[i].Status, results[i].Error = UpdateFailed, err.Error()
+			failed[agent.containerInfos.Config.Image] = true
+			continue
+		}
+		results[i].Status = UpdateUpdated
+	}
+	removeFormerImages(agents, results, failed)
+	endJobs(agents, results)
+	return results
+}
+
+//Create an agent for each container and start its job
+//Every container is inspected before anything is updated
+func (docker *DockerClient) newAgents(ctx context.Context, containers []ContainerInfo, token string, trigger string, push *PushEvent) ([]*ContainerAgent, []UpdateResult) {
+	results := make([]UpdateResult, len(containers))
+	agents := make([]*ContainerAgent, len(containers))
+	for i, container := range containers {
+		results[i].Name = container.Name()
+		agent, err := NewContainerAgent(ctx, docker, container.Id, container.Name(), token, nil)
+		if err != nil {
+			dockerLog.With("container", container.Name()).Errorf("Error while updating container: %v", err)
+			results[i].Status, results[i].Error = UpdateFailed, err.Error()
+		} else {
+			agents[i] = agent
+			agents[i].startJob(trigger, push)
+		}
+	}
+	return agents, results
+}
+
+//End the job of each agent with its result
+func endJobs(agents []*ContainerAgent, results []UpdateResult) {
+	for i, agent := range agents {
+		if agent != nil {
+			agent.endJob(results[i])
+		}
+	}
+}
+
+//Build or pull the image of each agent, an image shared by several agents is only updated once
+//The result status of agents that must be recreated is left empty
+//It returns the images for which an update failed
+func updateImages(agents []*ContainerAgent, results []UpdateResult) map[string]bool {
+	//Image name -> true if the image has been updated
+	prepared := make(map[string]bool)
+	//Image name -> job of the agent that updated the image
+	preparedBy := make(map[string]*Job)
+	failed := make(map[string]bool)
+	errors := make(map[string]string)
+	for i, agent := range agents {
+		if agent == nil {
+			continue
+		}
+		image := agent.containerInfos.Config.Image
+		updated, done := prepared[image]
+		if !done && !failed[image] {
+			var err error
+			if updated, err = agent.updateImage(); err != nil {
+				failed[image], errors[image] = true, err.Error()
+			} else {
+				prepared[image], preparedBy[image] = updated, agent.job
+			}
+		} else if job := preparedBy[image]; job != nil && agent.job != nil {
+			//The agents sharing the image get the commit and the digest of the update
+			agent.job.Commit, agent.job.Digest = job.Commit, job.Digest
+		}
+		if failed[image] {
+			results[i].Status, results[i].Error = UpdateFailed, errors[image]
+		} else if !updated {
+			results[i].Status = UpdateUpToDate
+		}
+	}
+	return failed
+}
+
+//Keep the former image of each recreated container as its rollback image and remove the untagged images
+//Nothing is done for an image group with a failed update, its containers may still use the former image
+func removeFormerImages(agents []*ContainerAgent, results []UpdateResult, failed map[string]bool) {
+	for i, agent := range agents {
+		if agent == nil || results[i].Status != UpdateUpdated || failed[agent.containerInfos.Config.Image] {
+			continue
+		}
+		//The error is logged by the agent, the container is already updated
+		agent.removeFormerImage()
+	}
+}
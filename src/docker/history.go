@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"sync"
+)
+
+const (
+	historySize    = 100  //Number of jobs kept in the history
+	historyLogSize = 1000 //Number of log lines kept for each job
+)
+
+//Job with the log lines it produced
+type JobRecord struct {
+	Job  Job      `json:"job"`
+	Logs []string `json:"logs"`
+}
+
+//Bounded in-memory history of the last jobs, fed by the job events of the bus
+//It backs the job log links posted to the forges, the subscription is lossless so that no job is left running
+type JobHistory struct {
+	mutex   sync.RWMutex
+	records map[string]*JobRecord
+	order   []string //Job ids from the oldest to the most recent
+}
+
+func NewJobHistory(bus *Bus) *JobHistory {
+	history := &JobHistory{records: make(map[string]*JobRecord)}
+	bus.SubscribeFunc("history", Lossless, Filter{Kinds: []EventKind{JobEventKind}}, history.onJobEvent)
+	return history
+}
+
+func (history *JobHistory) onJobEvent(event Event) {
+	if event.Job == nil {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	record, ok := history.records[event.Job.Id]
+	if !ok {
+		record = &JobRecord{Logs: make([]string, 0)}
+		history.records[event.Job.Id] = record
+		history.order = append(history.order, event.Job.Id)
+		if len(history.order) > historySize {
+			delete(history.records, history.order[0])
+			history.order = history.order[1:]
+		}
+	}
+	record.Job = *event.Job
+	if progress, ok := event.Data.(map[string]interface{}); ok {
+		if line, ok := progress["data"].(string); ok && len(record.Logs) < historyLogSize {
+			record.Logs = append(record.Logs, line)
+		}
+	}
+}
+
+//Get a copy of a job and of its logs
+func (history *JobHistory) Get(id string) (JobRecord, bool) {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+	record, ok := history.records[id]
+	if !ok {
+		return JobRecord{}, false
+	}
+	return JobRecord{Job: record.Job, Logs: append([]string{}, record.Logs...)}, true
+}
@@ -0,0 +1,33 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryKeepsTheEndOfABurst(t *testing.T) {
+	bus := NewBus()
+	history := NewJobHistory(bus)
+	job := Job{Id: "1a2b", Container: "app", Status: JobRunning}
+	bus.Publish(Event{Kind: JobEventKind, Type: JobStarted, Job: &job})
+	//More progress lines than a buffered subscription holds
+	for i := 0; i < 1000; i++ {
+		bus.Publish(Event{Kind: JobEventKind, Type: JobProgress, Job: &job, Data: map[string]interface{}{"data": "Pulling fs layer"}})
+	}
+	ended := job
+	ended.Status = UpdateUpdated
+	bus.Publish(Event{Kind: JobEventKind, Type: JobEnded, Job: &ended})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if record, ok := history.Get("1a2b"); ok && record.Job.Status == UpdateUpdated {
+			if len(record.Logs) != 1000 {
+				t.Errorf("got %d log lines, want 1000", len(record.Logs))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("end of the job not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
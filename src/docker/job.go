@@ -0,0 +1,134 @@
+package docker
+
+import (
+	"errors"
+	"time"
+
+	"dockerci/src/tracing"
+	"dockerci/src/utils"
+)
+
+const JobRunning = "running"
+
+const (
+	TriggerHook     = "hook"
+	TriggerRepo     = "repo"
+	TriggerProject  = "project"
+	TriggerRollback = "rollback"
+)
+
+//Update of a container triggered by a webhook
+//The status is JobRunning or one of the update result statuses once ended
+type Job struct {
+	Id          string    `json:"id"`
+	Container   string    `json:"container"`
+	ContainerId string    `json:"containerId"`
+	Trigger     string    `json:"trigger"`
+	Image       string    `json:"image"`
+	Repository  string    `json:"repository,omitempty"` //Git repository of the pushed or built commit
+	Commit      string    `json:"commit,omitempty"`     //Commit of the built image
+	Digest      string    `json:"digest,omitempty"`     //Digest of the pulled image
+	Status      string    `json:"status"`
+	StartedAt   time.Time `json:"startedAt"`
+	EndedAt     time.Time `json:"endedAt"`
+	Error       string    `json:"error,omitempty"`
+	Timeline    Timeline  `json:"timeline"`
+}
+
+//Start the job of the agent and publish it
+//The commit and the repository are taken from the push event or from the docker-ci.repo label
+func (agent *ContainerAgent) startJob(trigger string, push *PushEvent) {
+	agent.ctx, agent.span = tracing.Start(agent.ctx, "job "+agent.name, tracing.KindInternal)
+	agent.job = &Job{
+		Id:          utils.RandomHex(8),
+		Container:   agent.name,
+		ContainerId: agent.containerId,
+		Trigger:     trigger,
+		Image:       agent.containerInfos.Config.Image,
+		Status:      JobRunning,
+		StartedAt:   time.Now(),
+	}
+	if repo := agent.getLabel("repo"); repo != "" {
+		agent.job.Repository = RepositoryName(repo)
+	}
+	if push != nil {
+		agent.job.Commit = push.Sha
+		if push.CloneUrl != "" {
+			agent.job.Repository = RepositoryName(push.CloneUrl)
+		}
+	}
+	agent.log = agent.log.With("job", agent.job.Id)
+	if agent.docker.JobLogs != nil {
+		if file, err := agent.docker.JobLogs.Create(agent.name, agent.job.Id); err != nil {
+			agent.log.Warnf("Error while creating job log file: %v", err)
+		} else {
+			agent.logFile, agent.log = file, agent.log.Tee(file)
+		}
+	}
+	agent.log.Infof("Job started by %s for image %s", trigger, agent.job.Image)
+	agent.span.SetAttribute("job.id", agent.job.Id)
+	agent.span.SetAttribute("job.trigger", trigger)
+	agent.span.SetAttribute("container.name", agent.name)
+	agent.span.SetAttribute("container.image", agent.job.Image)
+	agent.publishJob(JobStarted, nil)
+}
+
+//Get the update result of the agent from the error of its update
+func (agent *ContainerAgent) result(err error) UpdateResult {
+	result := UpdateResult{Name: agent.name, Status: UpdateUpToDate}
+	if errors.Is(err, ErrShuttingDown) {
+		result.Status, result.Error = UpdateInterrupted, err.Error()
+	} else if err != nil {
+		result.Status, result.Error = UpdateFailed, err.Error()
+	} else if agent.updated {
+		result.Status = UpdateUpdated
+	}
+	return result
+}
+
+//End the job of the agent with the update result and publish it
+func (agent *ContainerAgent) endJob(result UpdateResult) {
+	if agent.job == nil {
+		return
+	}
+	if result.Error != "" {
+		agent.endPhase(errors.New(result.Error))
+	} else {
+		agent.endPhase(nil)
+	}
+	agent.job.Status, agent.job.Error = result.Status, result.Error
+	agent.job.EndedAt = time.Now()
+	agent.span.SetAttribute("job.status", result.Status)
+	if result.Error != "" {
+		agent.span.SetStatus(tracing.StatusError, result.Error)
+	}
+	agent.span.End()
+	if result.Error != "" {
+		agent.log.Errorf("Job ended with status %s: %s", result.Status, result.Error)
+	} else {
+		agent.log.Infof("Job ended with status %s", result.Status)
+	}
+	if agent.logFile != nil {
+		agent.logFile.Close()
+	}
+	agent.publishJob(JobEnded, nil)
+}
+
+//Publish a job event on the bus, a copy of the job is sent so that subscribers can keep it
+func (agent *ContainerAgent) publishJob(eventType string, data interface{}) {
+	if agent.job == nil || agent.docker.Bus == nil {
+		return
+	}
+	job := *agent.job
+	job.Timeline.Phases = append([]Phase{}, job.Timeline.Phases...)
+	job.Timeline.layerBytes = nil
+	agent.docker.Bus.Publish(Event{
+		Kind:        JobEventKind,
+		Type:        eventType,
+		ContainerId: agent.containerId,
+		Container:   agent.name,
+		Job:         &job,
+		Data:        data,
+	})
+}
+
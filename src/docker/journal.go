@@ -0,0 +1,208 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"dockerci/src/utils"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	RepairRunning   = "running"   //The container was already running again
+	RepairRestarted = "restarted" //The stopped container has been started
+	RepairRecreated = "recreated" //The removed container has been created again from its spec and started
+	RepairLost      = "lost"      //The container was removed and its entry has no spec
+	RepairFailed    = "failed"    //The repair failed, it is tried again on the next start
+)
+
+//Destructive step of a container update in progress
+//The entry is removed once the container is started again
+type JournalEntry struct {
+	Container   string         `json:"container"` //Name of the container, it is kept by the recreation
+	ContainerId string         `json:"containerId"`
+	JobId       string         `json:"jobId,omitempty"`
+	Step        string         `json:"step"` //Last step started : stop, remove, create or start
+	Time        time.Time      `json:"time"`
+	Spec        *ContainerSpec `json:"spec,omitempty"` //Inspected spec of the container before the update, nil for the restarts
+}
+
+//Outcome of the repair of an interrupted update
+type Repair struct {
+	Container string `json:"container"`
+	Step      string `json:"step"` //Step the update was interrupted at
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+//Journal of the container updates that have started stopping or recreating a container
+//It is written before each destructive step so that an update interrupted by a crash or a shutdown can be repaired on the next start
+type Journal struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]*JournalEntry //Container name -> entry
+}
+
+//Open the journal, an empty journal is returned if the file does not exist
+func OpenJournal(path string) (*Journal, error) {
+	journal := &Journal{path: path, entries: make(map[string]*JournalEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := make([]*JournalEntry, 0)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		journal.entries[entry.Container] = entry
+	}
+	return journal, nil
+}
+
+//Record the step a container update is starting, it replaces the former entry of the container
+func (journal *Journal) record(entry JournalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entry.Time = time.Now()
+	journal.entries[entry.Container] = &entry
+	return journal.save()
+}
+
+//Remove the entry of a container once it is running again
+func (journal *Journal) complete(container string) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if _, ok := journal.entries[container]; !ok {
+		return nil
+	}
+	delete(journal.entries, container)
+	return journal.save()
+}
+
+//Get the entries from the oldest to the most recent
+func (journal *Journal) Entries() []JournalEntry {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entries := make([]JournalEntry, 0, len(journal.entries))
+	for _, entry := range journal.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries
+}
+
+func (journal *Journal) save() error {
+	entries := make([]*JournalEntry, 0, len(journal.entries))
+	for _, entry := range journal.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(journal.path, data, 0600)
+}
+
+//Record a step of the agent container update with the spec of the container
+//It must succeed before the step is run, so that the container can always be recreated
+func (agent *ContainerAgent) journalStep(step string, containerId string) error {
+	if agent.docker.Journal == nil {
+		return nil
+	}
+	spec := specOf(agent.containerInfos)
+	entry := JournalEntry{Container: agent.containerName(), ContainerId: containerId, Step: step, Spec: &spec}
+	if agent.job != nil {
+		entry.JobId = agent.job.Id
+	}
+	return agent.docker.Journal.record(entry)
+}
+
+//Remove the journal entry of the agent container once it is running again
+func (agent *ContainerAgent) journalComplete() {
+	if agent.docker.Journal == nil {
+		return
+	}
+	if err := agent.docker.Journal.complete(agent.containerName()); err != nil {
+		agent.log.Warnf("Error while writing the update journal: %v", err)
+	}
+}
+
+//Record the stop of a compose container restarted with its dependencies, an empty step removes its entry once it is started
+func (docker *DockerClient) journalRestart(container ContainerInfo, step string) {
+	if docker.Journal == nil {
+		return
+	}
+	var err error
+	if step == "" {
+		err = docker.Journal.complete(container.Name())
+	} else {
+		err = docker.Journal.record(JournalEntry{Container: container.Name(), ContainerId: container.Id, Step: step})
+	}
+	if err != nil {
+		dockerLog.With("container", container.Name()).Errorf("Error while writing the update journal: %v", err)
+	}
+}
+
+//Repair the containers left stopped or removed by the updates interrupted by a crash or a shutdown
+//The stopped containers are started and the removed ones are created again from the spec of their entry
+//The repairs are kept to be reported by LastRepairs
+func (docker *DockerClient) Recover(ctx context.Context) []Repair {
+	repairs := make([]Repair, 0)
+	if docker.Journal == nil {
+		return repairs
+	}
+	for _, entry := range docker.Journal.Entries() {
+		repair := Repair{Container: entry.Container, Step: entry.Step}
+		container, err := docker.cli.ContainerInspect(ctx, entry.Container)
+		switch {
+		case client.IsErrNotFound(err) && entry.Spec == nil:
+			repair.Result, repair.Error = RepairLost, "container removed before being recreated"
+		case client.IsErrNotFound(err):
+			if id, err := docker.createFromSpec(ctx, *entry.Spec); err != nil {
+				repair.Result, repair.Error = RepairFailed, "Error while recreating container: "+err.Error()
+			} else if err := docker.cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+				repair.Result, repair.Error = RepairFailed, "Error while starting recreated container: "+err.Error()
+			} else {
+				repair.Result = RepairRecreated
+			}
+		case err != nil:
+			repair.Result, repair.Error = RepairFailed, err.Error()
+		case container.State.Running:
+			repair.Result = RepairRunning
+		default:
+			if err := docker.cli.ContainerStart(ctx, container.ID, types.ContainerStartOptions{}); err != nil {
+				repair.Result, repair.Error = RepairFailed, err.Error()
+			} else {
+				repair.Result = RepairRestarted
+			}
+		}
+		//Failed repairs are tried again on the next start
+		if repair.Result != RepairFailed {
+			if err := docker.Journal.complete(entry.Container); err != nil {
+				dockerLog.With("container", entry.Container).Errorf("Error while writing the update journal: %v", err)
+			}
+		}
+		repairs = append(repairs, repair)
+	}
+	docker.repairs.mutex.Lock()
+	docker.repairs.last = repairs
+	docker.repairs.mutex.Unlock()
+	return repairs
+}
+
+//Get the repairs made by the last recovery pass
+func (docker *DockerClient) LastRepairs() []Repair {
+	docker.repairs.mutex.Lock()
+	defer docker.repairs.mutex.Unlock()
+	return append([]Repair{}, docker.repairs.last...)
+}
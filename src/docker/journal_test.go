@@ -0,0 +1,221 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+)
+
+//Body of a container creation
+type createBody struct {
+	container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
+
+//Fake daemon with at most one container, it records the calls it gets
+type daemon struct {
+	mutex     sync.Mutex
+	exists    bool
+	running   bool
+	failStart bool
+	calls     []string
+	created   *createBody
+	connected map[string]*network.EndpointSettings
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v1.41")
+	d.calls = append(d.calls, req.Method+" "+path)
+	switch {
+	case req.Method == "GET" && strings.HasSuffix(path, "/json"):
+		if !d.exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "0123456789ab",
+			Name:  "/app",
+			State: &types.ContainerState{Running: d.running},
+		}})
+	case path == "/containers/create":
+		d.created = &createBody{}
+		json.NewDecoder(req.Body).Decode(d.created)
+		d.exists = true
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"fedcba987654"}`))
+	case strings.HasPrefix(path, "/networks/") && strings.HasSuffix(path, "/connect"):
+		var body struct{ EndpointConfig *network.EndpointSettings }
+		json.NewDecoder(req.Body).Decode(&body)
+		d.connected[strings.Split(path, "/")[2]] = body.EndpointConfig
+		w.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(path, "/start"):
+		if d.failStart {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"port is already allocated"}`))
+			return
+		}
+		d.running = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (d *daemon) started() bool {
+	for _, call := range d.calls {
+		if strings.HasSuffix(call, "/start") {
+			return true
+		}
+	}
+	return false
+}
+
+//Inspected container attached to a compose network and to a second network, with a mount and labels
+func inspectedContainer() types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   "0123456789abcdef",
+			Name: "/app",
+			HostConfig: &container.HostConfig{
+				NetworkMode: "app_default",
+				Mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: "app-data", Target: "/data"}},
+			},
+		},
+		Config: &container.Config{
+			Image:  "ghcr.io/owner/app:latest",
+			Env:    []string{"PORT=8080"},
+			Labels: map[string]string{"docker-ci.enable": "true", "com.docker.compose.project": "app"},
+		},
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"app_default": {NetworkID: "net1", Aliases: []string{"app", "0123456789ab"}, IPAddress: "172.18.0.2"},
+			"proxy":       {NetworkID: "net2", Aliases: []string{"web"}, IPAddress: "172.19.0.3"},
+		}},
+	}
+}
+
+func TestRecover(t *testing.T) {
+	spec := specOf(inspectedContainer())
+	tests := []struct {
+		name    string
+		daemon  *daemon
+		spec    *ContainerSpec
+		result  string
+		started bool
+		kept    bool
+	}{
+		{"still running", &daemon{exists: true, running: true}, &spec, RepairRunning, false, false},
+		{"stopped", &daemon{exists: true}, &spec, RepairRestarted, true, false},
+		{"stopped without spec", &daemon{exists: true}, nil, RepairRestarted, true, false},
+		{"removed", &daemon{}, &spec, RepairRecreated, true, false},
+		{"removed without spec", &daemon{}, nil, RepairLost, false, false},
+		{"start failed", &daemon{exists: true, failStart: true}, &spec, RepairFailed, true, true},
+		{"start of the recreated container failed", &daemon{failStart: true}, &spec, RepairFailed, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := test.daemon
+			d.connected = make(map[string]*network.EndpointSettings)
+			docker := fakeDocker(t, d.ServeHTTP)
+			path := filepath.Join(t.TempDir(), "journal.json")
+			journal, err := OpenJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := journal.record(JournalEntry{Container: "app", ContainerId: "0123456789abcdef", Step: StepRemove, Spec: test.spec}); err != nil {
+				t.Fatal(err)
+			}
+			docker.Journal = journal
+			repairs := docker.Recover(context.Background())
+			if len(repairs) != 1 || repairs[0].Result != test.result || repairs[0].Container != "app" || repairs[0].Step != StepRemove {
+				t.Fatalf("got repairs %+v, want %s", repairs, test.result)
+			}
+			if (repairs[0].Error != "") != (test.result == RepairFailed || test.result == RepairLost) {
+				t.Errorf("got error %q for %s", repairs[0].Error, test.result)
+			}
+			if d.started() != test.started {
+				t.Errorf("got calls %v, started: %v", d.calls, test.started)
+			}
+			if test.result == RepairRecreated && (d.created == nil || d.created.Image != spec.Config.Image) {
+				t.Errorf("container not recreated from the spec: %+v", d.created)
+			}
+			reopened, err := OpenJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := len(reopened.Entries()) == 1; kept != test.kept {
+				t.Errorf("entry kept: %v, want %v", kept, test.kept)
+			}
+			if last := docker.LastRepairs(); !reflect.DeepEqual(last, repairs) {
+				t.Errorf("got last repairs %+v", last)
+			}
+		})
+	}
+}
+
+func TestSpecRoundTrip(t *testing.T) {
+	infos := inspectedContainer()
+	spec := specOf(infos)
+	if spec.Name != "app" {
+		t.Errorf("got name %q", spec.Name)
+	}
+	//The addresses given by docker and the short id alias are dropped
+	if endpoint := spec.NetworkingConfig.EndpointsConfig["app_default"]; endpoint.IPAddress != "" || !reflect.DeepEqual(endpoint.Aliases, []string{"app"}) {
+		t.Errorf("got endpoint %+v", endpoint)
+	}
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.record(JournalEntry{Container: "app", Step: StepCreate, Spec: &spec}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := reopened.Entries()
+	if len(entries) != 1 || entries[0].Spec == nil {
+		t.Fatalf("got entries %+v", entries)
+	}
+	saved := *entries[0].Spec
+	if !reflect.DeepEqual(saved.Config.Labels, infos.Config.Labels) || !reflect.DeepEqual(saved.Config.Env, infos.Config.Env) {
+		t.Errorf("got config %+v", saved.Config)
+	}
+	if !reflect.DeepEqual(saved.HostConfig.Mounts, infos.HostConfig.Mounts) || saved.HostConfig.NetworkMode != "app_default" {
+		t.Errorf("got host config %+v", saved.HostConfig)
+	}
+	if !reflect.DeepEqual(saved.NetworkingConfig, spec.NetworkingConfig) {
+		t.Errorf("got networks %+v, want %+v", saved.NetworkingConfig.EndpointsConfig, spec.NetworkingConfig.EndpointsConfig)
+	}
+
+	//The container is created on the network of its network mode and connected to the other one
+	d := &daemon{connected: make(map[string]*network.EndpointSettings)}
+	docker := fakeDocker(t, d.ServeHTTP)
+	if _, err := docker.createFromSpec(context.Background(), saved); err != nil {
+		t.Fatal(err)
+	}
+	if d.created == nil || !reflect.DeepEqual(d.created.Labels, infos.Config.Labels) || !reflect.DeepEqual(d.created.HostConfig.Mounts, infos.HostConfig.Mounts) {
+		t.Fatalf("got creation %+v", d.created)
+	}
+	if primary := d.created.NetworkingConfig.EndpointsConfig; len(primary) != 1 || primary["app_default"] == nil || !reflect.DeepEqual(primary["app_default"].Aliases, []string{"app"}) {
+		t.Errorf("got networks %+v at creation", primary)
+	}
+	if proxy := d.connected["proxy"]; len(d.connected) != 1 || proxy == nil || !reflect.DeepEqual(proxy.Aliases, []string{"web"}) {
+		t.Errorf("got connected networks %+v", d.connected)
+	}
+}
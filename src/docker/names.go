@@ -0,0 +1,60 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Get all the hook names of the container, the main hook name comes first
+func (container *ContainerInfo) HookNames() []string {
+	names := make([]string, 0, len(container.Aliases)+1)
+	if container.Hook != "" {
+		names = append(names, container.Hook)
+	}
+	return append(names, container.Aliases...)
+}
+
+//Set the hook name and the aliases of the containers from their labels
+//The hook name is the docker-ci.name label or the container name
+//Aliases are read from the comma separated docker-ci.aliases label
+//If several containers claim the same hook name, they are all flagged with an error
+//It returns the conflicting hook names with the containers claiming them
+func ResolveHookNames(containers []ContainerInfo) map[string][]string {
+	claims := make(map[string][]string)
+	for i := range containers {
+		container := &containers[i]
+		container.Hook = strings.ToLower(strings.TrimSpace(container.Labels["docker-ci.name"]))
+		if container.Hook == "" {
+			container.Hook = strings.ToLower(container.Name())
+		}
+		container.Aliases = make([]string, 0)
+		for _, alias := range strings.Split(container.Labels["docker-ci.aliases"], ",") {
+			if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" && alias != container.Hook {
+				container.Aliases = append(container.Aliases, alias)
+			}
+		}
+		container.Error = ""
+		for _, name := range container.HookNames() {
+			claims[name] = append(claims[name], container.Name())
+		}
+	}
+	conflicts := make(map[string][]string)
+	for name, claimers := range claims {
+		if len(claimers) > 1 {
+			sort.Strings(claimers)
+			conflicts[name] = claimers
+		}
+	}
+	for i := range containers {
+		container := &containers[i]
+		errors := make([]string, 0)
+		for _, name := range container.HookNames() {
+			if claimers, ok := conflicts[name]; ok {
+				errors = append(errors, fmt.Sprintf("hook name %s is claimed by %s", name, strings.Join(claimers, ", ")))
+			}
+		}
+		container.Error = strings.Join(errors, "; ")
+	}
+	return conflicts
+}
@@ -0,0 +1,93 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"dockerci/src/utils"
+)
+
+//Update request kept until it has run, so that it is resumed after a restart
+type QueuedUpdate struct {
+	Id       string     `json:"id"`
+	Trigger  string     `json:"trigger"`          //TriggerHook, TriggerRepo or TriggerProject
+	Target   string     `json:"target,omitempty"` //Hook name or compose project
+	Token    string     `json:"token,omitempty"`
+	Push     *PushEvent `json:"push,omitempty"`
+	QueuedAt time.Time  `json:"queuedAt"`
+}
+
+//Persisted list of the update requests that have not run yet
+//The file is written with restricted permissions as the requests carry their hook token
+type UpdateQueue struct {
+	mutex   sync.Mutex
+	path    string
+	updates map[string]*QueuedUpdate
+}
+
+//Open the queue, an empty queue is returned if the file does not exist
+func OpenUpdateQueue(path string) (*UpdateQueue, error) {
+	queue := &UpdateQueue{path: path, updates: make(map[string]*QueuedUpdate)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	} else if err != nil {
+		return nil, err
+	}
+	updates := make([]*QueuedUpdate, 0)
+	if err := json.Unmarshal(data, &updates); err != nil {
+		return nil, err
+	}
+	for _, update := range updates {
+		queue.updates[update.Id] = update
+	}
+	return queue, nil
+}
+
+//Add an update request and return its id
+func (queue *UpdateQueue) Add(update QueuedUpdate) (string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	update.Id, update.QueuedAt = utils.RandomHex(8), time.Now()
+	queue.updates[update.Id] = &update
+	return update.Id, queue.save()
+}
+
+//Remove an update request once it has run
+func (queue *UpdateQueue) Remove(id string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if _, ok := queue.updates[id]; !ok {
+		return nil
+	}
+	delete(queue.updates, id)
+	return queue.save()
+}
+
+//Get the update requests from the oldest to the most recent
+func (queue *UpdateQueue) List() []QueuedUpdate {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	updates := make([]QueuedUpdate, 0, len(queue.updates))
+	for _, update := range queue.updates {
+		updates = append(updates, *update)
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].QueuedAt.Before(updates[j].QueuedAt) })
+	return updates
+}
+
+func (queue *UpdateQueue) save() error {
+	updates := make([]*QueuedUpdate, 0, len(queue.updates))
+	for _, update := range queue.updates {
+		updates = append(updates, update)
+	}
+	data, err := json.MarshalIndent(updates, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(queue.path, data, 0600)
+}
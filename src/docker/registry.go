@@ -0,0 +1,300 @@
+package docker
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+//Thread safe registry of the docker-ci enabled containers
+//Containers are indexed by id, hook name, alias and repository
+type Registry struct {
+	docker     *DockerClient
+	mutex      sync.RWMutex
+	containers []ContainerInfo
+	byId       map[string]int
+	byHook     map[string]int
+	byRepo     map[string][]int
+	conflicts  map[string][]string
+	loaded     bool //The containers have been listed from docker at least once
+}
+
+func NewRegistry(docker *DockerClient) *Registry {
+	registry := &Registry{docker: docker}
+	registry.set(make([]ContainerInfo, 0))
+	return registry
+}
+
+//Load all the enabled containers from docker and replace the registry content
+func (registry *Registry) Load() error {
+	containers, err := registry.docker.listEnabledContainers()
+	if err != nil {
+		return err
+	}
+	registry.set(containers)
+	registry.setLoaded()
+	for _, container := range containers {
+		if container.Error != "" {
+			dockerLog.With("container", container.Name()).Warnf("%s", container.Error)
+		}
+	}
+	return nil
+}
+
+//Periodically compare the registry with the docker containers and repair drift
+//It can happen if a docker event was missed
+func (registry *Registry) Reconcile(interval time.Duration) {
+	for range time.Tick(interval) {
+		containers, err := registry.docker.listEnabledContainers()
+		if err != nil {
+			dockerLog.Errorf("Error while reconciling containers: %v", err)
+			continue
+		}
+		if added, removed, changed := registry.diff(containers); len(added) > 0 || len(removed) > 0 || len(changed) > 0 {
+			dockerLog.Warnf("Registry drift detected, added: %v, removed: %v, changed: %v", added, removed, changed)
+		}
+		registry.set(containers)
+		registry.setLoaded()
+	}
+}
+
+//Update the registry from a docker container event
+//The container is inspected again so that its names, labels and state are up to date
+func (registry *Registry) HandleEvent(event Event) {
+	if ContainerEvent(event.Type) == Destroy_container {
+		registry.remove(event.ContainerId)
+		return
+	}
+	container, err := registry.docker.cli.ContainerInspect(context.Background(), event.ContainerId)
+	if err != nil || container.Config.Labels["docker-ci.enable"] != "true" {
+		registry.remove(event.ContainerId)
+		return
+	}
+	registry.upsert(containerInfoFromJSON(container))
+}
+
+//Check if the containers have been listed from docker at least once
+func (registry *Registry) Loaded() bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.loaded
+}
+
+func (registry *Registry) setLoaded() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.loaded = true
+}
+
+//Get a copy of all the registered containers
+func (registry *Registry) List() []ContainerInfo {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	containers := make([]ContainerInfo, len(registry.containers))
+	copy(containers, registry.containers)
+	return containers
+}
+
+//Get a container from its hook name or one of its aliases
+//Conflicting hook names are not resolved
+func (registry *Registry) GetByName(name string) (ContainerInfo, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	if i, ok := registry.byHook[strings.ToLower(name)]; ok {
+		return registry.containers[i], true
+	}
+	return ContainerInfo{}, false
+}
+
+//Get a container from its id
+func (registry *Registry) GetById(id string) (ContainerInfo, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	if i, ok := registry.byId[id]; ok {
+		return registry.containers[i], true
+	}
+	return ContainerInfo{}, false
+}
+
+//Get all the containers built from a repository
+func (registry *Registry) GetByRepository(cloneUrl string) []ContainerInfo {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	containers := make([]ContainerInfo, 0)
+	for _, i := range registry.byRepo[gitRepositoryPath(cloneUrl)] {
+		containers = append(containers, registry.containers[i])
+	}
+	return containers
+}
+
+//Get all the containers of a compose project
+func (registry *Registry) GetByProject(project string) []ContainerInfo {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	containers := make([]ContainerInfo, 0)
+	for _, container := range registry.containers {
+		if container.Project() == project {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+//Get the containers claiming a hook name if several of them do
+func (registry *Registry) Conflict(name string) ([]string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	claimers, ok := registry.conflicts[strings.ToLower(name)]
+	return claimers, ok
+}
+
+//Replace the registry content and rebuild the indexes
+func (registry *Registry) set(containers []ContainerInfo) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.rebuild(containers)
+}
+
+//Add a container to the registry or replace it if it already exists
+func (registry *Registry) upsert(container ContainerInfo) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	containers := make([]ContainerInfo, len(registry.containers), len(registry.containers)+1)
+	copy(containers, registry.containers)
+	if i, ok := registry.byId[container.Id]; ok {
+		containers[i] = container
+	} else {
+		containers = append(containers, container)
+	}
+	registry.rebuild(containers)
+}
+
+//Remove a container from the registry if it exists
+func (registry *Registry) remove(id string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if i, ok := registry.byId[id]; ok {
+		containers := make([]ContainerInfo, 0, len(registry.containers))
+		containers = append(containers, registry.containers[:i]...)
+		registry.rebuild(append(containers, registry.containers[i+1:]...))
+	}
+}
+
+//Set the registry content and rebuild the indexes, the write lock must be held
+//The changes compared to the former content are published on the bus
+func (registry *Registry) rebuild(containers []ContainerInfo) {
+	conflicts := ResolveHookNames(containers)
+	former, formerIds := registry.containers, registry.byId
+	registry.byId = make(map[string]int)
+	registry.byHook = make(map[string]int)
+	registry.byRepo = make(map[string][]int)
+	for i, container := range containers {
+		registry.byId[container.Id] = i
+		for _, name := range container.HookNames() {
+			if _, conflict := conflicts[name]; !conflict {
+				registry.byHook[name] = i
+			}
+		}
+		if repoPath := container.repositoryPath(); repoPath != "" {
+			registry.byRepo[repoPath] = append(registry.byRepo[repoPath], i)
+		}
+	}
+	registry.containers, registry.conflicts = containers, conflicts
+	registry.publishChanges(former, formerIds)
+}
+
+//Publish the differences between the former and the current registry content
+func (registry *Registry) publishChanges(former []ContainerInfo, formerIds map[string]int) {
+	if registry.docker == nil || registry.docker.Bus == nil {
+		return
+	}
+	publish := func(eventType string, container ContainerInfo) {
+		registry.docker.Bus.Publish(Event{
+			Kind:        RegistryEventKind,
+			Type:        eventType,
+			ContainerId: container.Id,
+			Container:   container.Name(),
+			Data:        container,
+		})
+	}
+	for _, container := range registry.containers {
+		if i, ok := formerIds[container.Id]; !ok {
+			publish(RegistryAdded, container)
+		} else if !reflect.DeepEqual(former[i], container) {
+			publish(RegistryUpdated, container)
+		}
+	}
+	for _, container := range former {
+		if _, ok := registry.byId[container.Id]; !ok {
+			publish(RegistryRemoved, container)
+		}
+	}
+}
+
+//Get the containers added, removed and renamed or relabeled compared to the registry content
+func (registry *Registry) diff(containers []ContainerInfo) (added []string, removed []string, changed []string) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	ids := make(map[string]bool)
+	for _, container := range containers {
+		ids[container.Id] = true
+		if i, ok := registry.byId[container.Id]; !ok {
+			added = append(added, container.Name())
+		} else if current := registry.containers[i]; current.Name() != container.Name() || !reflect.DeepEqual(current.Labels, container.Labels) {
+			changed = append(changed, container.Name())
+		}
+	}
+	for _, container := range registry.containers {
+		if !ids[container.Id] {
+			removed = append(removed, container.Name())
+		}
+	}
+	return added, removed, changed
+}
+
+//Get all the enabled containers from docker
+func (docker *DockerClient) listEnabledContainers() ([]ContainerInfo, error) {
+	containers, err := docker.cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	enabled := make([]ContainerInfo, 0)
+	for _, container := range containers {
+		if container.Labels["docker-ci.enable"] != "true" {
+			continue
+		}
+		//Containers are inspected to get their full state
+		if infos, err := docker.cli.ContainerInspect(context.Background(), container.ID); err == nil {
+			enabled = append(enabled, containerInfoFromJSON(infos))
+		}
+	}
+	return enabled, nil
+}
+
+//Build a ContainerInfo from an inspected container
+func containerInfoFromJSON(container types.ContainerJSON) ContainerInfo {
+	info := ContainerInfo{
+		Names:  []string{container.Name},
+		Id:     container.ID,
+		Image:  container.Config.Image,
+		Labels: container.Config.Labels,
+	}
+	if state := container.State; state != nil {
+		info.State = ContainerState{
+			Status:       state.Status,
+			Running:      state.Running,
+			ExitCode:     state.ExitCode,
+			RestartCount: container.RestartCount,
+			StartedAt:    state.StartedAt,
+			FinishedAt:   state.FinishedAt,
+		}
+		if state.Health != nil {
+			info.State.Health = state.Health.Status
+		}
+	}
+	return info
+}
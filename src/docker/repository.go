@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Placeholder of the repository links replaced by the token of the hook
+var tokenPlaceholder = regexp.MustCompile(`{{.+}}`)
+
+//Normalize a git remote link or a repository name to host/owner/name
+//Credentials, scheme, branch and .git suffix are removed, the port stays in the host
+//The scp like links (git@github.com:owner/name.git) are supported, a normalized name is left unchanged
+func RepositoryName(link string) string {
+	link = strings.ToLower(strings.TrimSpace(link))
+	if i := strings.Index(link, "#"); i != -1 {
+		link = link[:i]
+	}
+	if i := strings.Index(link, "://"); i != -1 {
+		link = link[i+3:]
+	} else if i := strings.Index(link, ":"); i != -1 && !strings.Contains(link[:i], "/") && !isPort(link[i+1:]) {
+		//scp like syntax, the colon separates the host from the path
+		link = link[:i] + "/" + link[i+1:]
+	}
+	if i := strings.LastIndex(link, "@"); i != -1 {
+		link = link[i+1:]
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(link, "/"), ".git")
+}
+
+//Check if the rest of a link after a colon starts with a port (host:port/owner/name)
+func isPort(rest string) bool {
+	if i := strings.Index(rest, "/"); i != -1 {
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return false
+	}
+	for _, c := range rest {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//Normalize a git remote link to a comparable path (owner/name), the host is removed
+func gitRepositoryPath(link string) string {
+	name := RepositoryName(link)
+	if i := strings.Index(name, "/"); i != -1 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+//Normalize an image name to a comparable path (owner/name)
+//Registry host, tag and digest are removed
+func imageRepositoryPath(image string) string {
+	image = strings.ToLower(strings.TrimSpace(image))
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[1]
+	}
+	return image
+}
+
+//Get the repository path of the container (owner/name)
+//It is read from the docker-ci.repo label or from the container image
+func (container *ContainerInfo) repositoryPath() string {
+	if repo := container.Labels["docker-ci.repo"]; repo != "" {
+		return gitRepositoryPath(repo)
+	}
+	return imageRepositoryPath(container.Image)
+}
+
+//Check if the docker-ci.repo link of the container has a {{TOKEN}} placeholder, the token must then be given by the hook
+func (container *ContainerInfo) NeedsToken() bool {
+	return tokenPlaceholder.MatchString(container.Labels["docker-ci.repo"])
+}
+
+//Get the name of the container without the leading slash
+func (container *ContainerInfo) Name() string {
+	if len(container.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+//Sort containers according to their docker-ci.order label (lowest first)
+//Containers without order label are updated last, ties are sorted by name
+func SortContainers(containers []ContainerInfo) {
+	order := func(container *ContainerInfo) int {
+		if order, err := strconv.Atoi(container.Labels["docker-ci.order"]); err == nil {
+			return order
+		}
+		return int(^uint(0) >> 1)
+	}
+	sort.SliceStable(containers, func(i, j int) bool {
+		if oi, oj := order(&containers[i]), order(&containers[j]); oi != oj {
+			return oi < oj
+		}
+		return containers[i].Name() < containers[j].Name()
+	})
+}
@@ -0,0 +1,36 @@
+package docker
+
+import "testing"
+
+func TestRepositoryName(t *testing.T) {
+	tests := []struct {
+		link string
+		name string
+		path string
+	}{
+		{"https://github.com/Owner/App.git", "github.com/owner/app", "owner/app"},
+		{"https://{{TOKEN}}@github.com/owner/app.git#develop", "github.com/owner/app", "owner/app"},
+		{"https://user:p@ss@github.com/owner/app", "github.com/owner/app", "owner/app"},
+		{"git@github.com:owner/app.git", "github.com/owner/app", "owner/app"},
+		{"ssh://git@gitea.example.com:2222/owner/app.git", "gitea.example.com:2222/owner/app", "owner/app"},
+		{"https://gitea.example.com:3000/owner/app/", "gitea.example.com:3000/owner/app", "owner/app"},
+		{"gitea.example.com:3000/owner/app", "gitea.example.com:3000/owner/app", "owner/app"},
+		{"github.com/owner/app", "github.com/owner/app", "owner/app"},
+		{"app", "app", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			name := RepositoryName(test.link)
+			if name != test.name {
+				t.Errorf("got name %q, want %q", name, test.name)
+			}
+			//A normalized name is left unchanged so that the forges can be looked up from the job repository
+			if again := RepositoryName(name); again != name {
+				t.Errorf("got %q from the normalized name %q", again, name)
+			}
+			if path := gitRepositoryPath(test.link); path != test.path {
+				t.Errorf("got path %q, want %q", path, test.path)
+			}
+		})
+	}
+}
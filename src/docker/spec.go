@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+//Definition of a container, enough to create it again once it has been removed
+type ContainerSpec struct {
+	Name             string                    `json:"name"`
+	Config           *container.Config         `json:"config"`
+	HostConfig       *container.HostConfig     `json:"hostConfig"`
+	NetworkingConfig *network.NetworkingConfig `json:"networkingConfig"`
+}
+
+//Get the spec of an inspected container
+//Only the configuration of the network endpoints is kept, the addresses given by docker are dropped
+func specOf(infos types.ContainerJSON) ContainerSpec {
+	spec := ContainerSpec{
+		Name:             strings.TrimPrefix(infos.Name, "/"),
+		Config:           infos.Config,
+		HostConfig:       infos.HostConfig,
+		NetworkingConfig: &network.NetworkingConfig{EndpointsConfig: make(map[string]*network.EndpointSettings)},
+	}
+	if infos.NetworkSettings == nil {
+		return spec
+	}
+	for name, endpoint := range infos.NetworkSettings.Networks {
+		if endpoint == nil {
+			continue
+		}
+		aliases := make([]string, 0, len(endpoint.Aliases))
+		for _, alias := range endpoint.Aliases {
+			//Docker adds the short id of the container, it would be a stale alias for the new container
+			if !strings.HasPrefix(infos.ID, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+		if len(aliases) == 0 {
+			aliases = nil
+		}
+		spec.NetworkingConfig.EndpointsConfig[name] = &network.EndpointSettings{
+			IPAMConfig: endpoint.IPAMConfig,
+			Links:      endpoint.Links,
+			Aliases:    aliases,
+			NetworkID:  endpoint.NetworkID,
+			DriverOpts: endpoint.DriverOpts,
+		}
+	}
+	return spec
+}
+
+//Create a container from its spec and connect it to all its networks
+//Docker only accepts one network at creation, the network of the network mode is given first and the other ones are connected afterwards
+func (docker *DockerClient) createFromSpec(ctx context.Context, spec ContainerSpec) (string, error) {
+	primary := &network.NetworkingConfig{EndpointsConfig: make(map[string]*network.EndpointSettings)}
+	others := make(map[string]*network.EndpointSettings)
+	if spec.NetworkingConfig != nil {
+		mode := ""
+		if spec.HostConfig != nil {
+			mode = string(spec.HostConfig.NetworkMode)
+		}
+		for name, endpoint := range spec.NetworkingConfig.EndpointsConfig {
+			if name == mode || (mode == "default" && name == "bridge") {
+				primary.EndpointsConfig[name] = endpoint
+			} else {
+				others[name] = endpoint
+			}
+		}
+	}
+	created, err := docker.cli.ContainerCreate(ctx, spec.Config, spec.HostConfig, primary, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	for name, endpoint := range others {
+		if err := docker.cli.NetworkConnect(ctx, name, created.ID, endpoint); err != nil {
+			return created.ID, err
+		}
+	}
+	return created.ID, nil
+}
@@ -0,0 +1,127 @@
+package docker
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+//Phases of a job, each of them is published with a start and an end event
+const (
+	PhasePull        = "pull"
+	PhaseBuild       = "build"
+	PhaseStop        = "stop"
+	PhaseRecreate    = "recreate"
+	PhaseStart       = "start"
+	PhaseRemoveImage = "remove-image"
+	PhaseRollback    = "rollback"
+)
+
+const (
+	JobPhaseStarted = "job.phase.started"
+	JobPhaseEnded   = "job.phase.ended"
+)
+
+//Timing of a job phase, the end is zero while the phase is running
+type Phase struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//Phases of a job with the transfer and build statistics
+type Timeline struct {
+	Phases           []Phase `json:"phases"`
+	BytesPulled      int64   `json:"bytesPulled"`
+	LayersDownloaded int     `json:"layersDownloaded"`
+	LayersCached     int     `json:"layersCached"` //Layers already present on the host
+	BuildSteps       int     `json:"buildSteps"`   //The images are built without cache, every step is executed
+	layerBytes       map[string]int64
+}
+
+//Progress message of an image pull
+type pullMessage struct {
+	Status         string `json:"status"`
+	Id             string `json:"id"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+//Output message of an image build
+type buildMessage struct {
+	Stream string `json:"stream"`
+}
+
+//Get the running phase of the timeline
+func (timeline *Timeline) current() *Phase {
+	if n := len(timeline.Phases); n > 0 && timeline.Phases[n-1].EndedAt.IsZero() {
+		return &timeline.Phases[n-1]
+	}
+	return nil
+}
+
+//Start a phase of the job, the running phase is ended first
+func (agent *ContainerAgent) startPhase(name string) {
+	if agent.job == nil {
+		return
+	}
+	agent.endPhase(nil)
+	agent.job.Timeline.Phases = append(agent.job.Timeline.Phases, Phase{Name: name, StartedAt: time.Now()})
+	agent.publishJob(JobPhaseStarted, agent.job.Timeline.Phases[len(agent.job.Timeline.Phases)-1])
+}
+
+//End the running phase of the job with an optional error
+func (agent *ContainerAgent) endPhase(err error) {
+	if agent.job == nil {
+		return
+	}
+	phase := agent.job.Timeline.current()
+	if phase == nil {
+		return
+	}
+	phase.EndedAt = time.Now()
+	phase.DurationMs = phase.EndedAt.Sub(phase.StartedAt).Milliseconds()
+	if err != nil {
+		phase.Error = err.Error()
+	}
+	agent.publishJob(JobPhaseEnded, *phase)
+}
+
+//Count the layers and the bytes of a pull progress message
+//The downloaded bytes of a layer are the highest progress reported for it
+func (agent *ContainerAgent) recordPull(line string) {
+	var msg pullMessage
+	if agent.job == nil || json.Unmarshal([]byte(line), &msg) != nil {
+		return
+	}
+	timeline := &agent.job.Timeline
+	switch msg.Status {
+	case "Downloading":
+		if timeline.layerBytes == nil {
+			timeline.layerBytes = make(map[string]int64)
+		}
+		if msg.ProgressDetail.Current > timeline.layerBytes[msg.Id] {
+			timeline.BytesPulled += msg.ProgressDetail.Current - timeline.layerBytes[msg.Id]
+			timeline.layerBytes[msg.Id] = msg.ProgressDetail.Current
+		}
+	case "Pull complete":
+		timeline.LayersDownloaded++
+	case "Already exists":
+		timeline.LayersCached++
+	}
+}
+
+//Count the steps of a build output message
+func (agent *ContainerAgent) recordBuild(line string) {
+	var msg buildMessage
+	if agent.job == nil || json.Unmarshal([]byte(line), &msg) != nil {
+		return
+	}
+	if strings.HasPrefix(msg.Stream, "Step ") {
+		agent.job.Timeline.BuildSteps++
+	}
+}
@@ -0,0 +1,165 @@
+package forge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/docker"
+	"dockerci/src/utils"
+)
+
+const (
+	Github = "github"
+	Gitea  = "gitea"
+)
+
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+//Forge repository to which the deploy statuses are reported
+type Repository struct {
+	Name        string    `json:"repository"` //host/owner/name
+	Type        string    `json:"type"`       //github or gitea
+	ApiUrl      string    `json:"apiUrl"`
+	Deployments bool      `json:"deployments"` //Create Github deployments in addition to the commit statuses
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+//Repository as it is persisted with its api token
+type record struct {
+	Repository
+	Token string `json:"token"`
+}
+
+//Forge repository store persisted in a json file
+type Store struct {
+	path         string
+	mutex        sync.RWMutex
+	repositories map[string]*record
+}
+
+//Open the forge repository store from a json file, the file is created on the first save
+func Open(path string) (*Store, error) {
+	store := &Store{path: path, repositories: make(map[string]*record)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := make([]*record, 0)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		store.repositories[record.Name] = record
+	}
+	return store, nil
+}
+
+//Add or update a repository, the current token is kept if the token is empty
+//The type and the api url default to Github for github.com and to Gitea for the other hosts
+func (store *Store) Set(repository Repository, token string) (Repository, error) {
+	repository.Name = docker.RepositoryName(repository.Name)
+	if strings.Count(repository.Name, "/") != 2 {
+		return Repository{}, errors.New("repository must be host/owner/name or a clone url")
+	}
+	host := strings.SplitN(repository.Name, "/", 2)[0]
+	if repository.Type == "" {
+		repository.Type = Gitea
+		if host == "github.com" {
+			repository.Type = Github
+		}
+	}
+	if repository.Type != Github && repository.Type != Gitea {
+		return Repository{}, errors.New("type must be github or gitea")
+	}
+	if repository.ApiUrl == "" {
+		if repository.Type == Github {
+			repository.ApiUrl = "https://api.github.com"
+		} else {
+			repository.ApiUrl = "https://" + host + "/api/v1"
+		}
+	}
+	repository.ApiUrl = strings.TrimSuffix(repository.ApiUrl, "/")
+	if repository.Deployments && repository.Type != Github {
+		return Repository{}, errors.New("deployments are only supported by github")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if token == "" {
+		current, ok := store.repositories[repository.Name]
+		if !ok {
+			return Repository{}, errors.New("token is required")
+		}
+		token = current.Token
+	}
+	repository.UpdatedAt = time.Now()
+	previous := store.repositories[repository.Name]
+	store.repositories[repository.Name] = &record{Repository: repository, Token: token}
+	if err := store.save(); err != nil {
+		if previous != nil {
+			store.repositories[repository.Name] = previous
+		} else {
+			delete(store.repositories, repository.Name)
+		}
+		return Repository{}, err
+	}
+	return repository, nil
+}
+
+//Get a repository and its token from its name or its clone url
+func (store *Store) Get(name string) (Repository, string, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, ok := store.repositories[docker.RepositoryName(name)]
+	if !ok {
+		return Repository{}, "", false
+	}
+	return record.Repository, record.Token, true
+}
+
+//List the repositories sorted by name, the tokens are not returned
+func (store *Store) List() []Repository {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	repositories := make([]Repository, 0, len(store.repositories))
+	for _, record := range store.repositories {
+		repositories = append(repositories, record.Repository)
+	}
+	sort.Slice(repositories, func(i, j int) bool { return repositories[i].Name < repositories[j].Name })
+	return repositories
+}
+
+func (store *Store) Delete(name string) error {
+	name = docker.RepositoryName(name)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	record, ok := store.repositories[name]
+	if !ok {
+		return ErrRepositoryNotFound
+	}
+	delete(store.repositories, name)
+	if err := store.save(); err != nil {
+		store.repositories[name] = record
+		return err
+	}
+	return nil
+}
+
+func (store *Store) save() error {
+	records := make([]*record, 0, len(store.repositories))
+	for _, record := range store.repositories {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(store.path, data, 0600)
+}
@@ -0,0 +1,247 @@
+package forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"dockerci/src/docker"
+	"dockerci/src/logger"
+)
+
+//Label giving the Github deployment environment of a container, the container name is used by default
+const environmentLabel = "docker-ci.environment"
+
+//Maximum length of a commit status description
+const descriptionMaxLength = 140
+
+const (
+	queueSize = 256            //Maximum number of statuses waiting to be posted, the next ones are dropped
+	reportTTL = 24 * time.Hour //Time after which the report of a job that never ended is forgotten
+)
+
+//Logger of the forge entries
+var forgeLog = logger.Default.With("component", "forge")
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+//Commit status and deployment reported for a running job
+type report struct {
+	sha          string
+	repository   Repository
+	token        string
+	deploymentId int64 //Only used by the worker
+	createdAt    time.Time
+}
+
+//Status of a job waiting to be posted by the worker
+type task struct {
+	report *report
+	job    *docker.Job
+	end    bool
+}
+
+//Report the jobs to the commit statuses and the deployments of the forge repositories of the store
+//A pending status is posted as soon as the commit of a job is known and the final status when the job ends
+//The statuses are posted in order by a worker so that a slow forge doesn't block the bus
+type Reporter struct {
+	store    *Store
+	registry *docker.Registry
+	reports  map[string]*report //Job id -> report, only used by the bus handler goroutine
+	queue    chan task
+}
+
+func NewReporter(store *Store, registry *docker.Registry) *Reporter {
+	reporter := &Reporter{store: store, registry: registry, reports: make(map[string]*report), queue: make(chan task, queueSize)}
+	go reporter.work()
+	return reporter
+}
+
+func (reporter *Reporter) OnJobEvent(event docker.Event) {
+	job := event.Job
+	if job == nil || job.Repository == "" {
+		return
+	}
+	reporter.expire()
+	current, ok := reporter.reports[job.Id]
+	if !ok && job.Commit != "" {
+		repository, token, found := reporter.store.Get(job.Repository)
+		if !found {
+			return
+		}
+		current = &report{sha: job.Commit, repository: repository, token: token, createdAt: time.Now()}
+		reporter.reports[job.Id] = current
+		reporter.enqueue(task{report: current, job: job})
+	}
+	if event.Type == docker.JobEnded {
+		delete(reporter.reports, job.Id)
+		if current != nil {
+			reporter.enqueue(task{report: current, job: job, end: true})
+		}
+	}
+}
+
+//Forget the reports of the jobs whose end has not been received
+func (reporter *Reporter) expire() {
+	for id, current := range reporter.reports {
+		if time.Since(current.createdAt) > reportTTL {
+			delete(reporter.reports, id)
+		}
+	}
+}
+
+//Queue a status without waiting, it is dropped if the queue is full
+func (reporter *Reporter) enqueue(next task) {
+	select {
+	case reporter.queue <- next:
+	default:
+		forgeLog.With("container", next.job.Container).With("repository", next.report.repository.Name).Warnf("Forge report queue is full, status dropped")
+	}
+}
+
+//Post the queued statuses
+func (reporter *Reporter) work() {
+	for next := range reporter.queue {
+		if next.end {
+			reporter.end(next.report, next.job)
+		} else {
+			reporter.start(next.report, next.job)
+		}
+	}
+}
+
+//Post the pending status and create the deployment of a job
+func (reporter *Reporter) start(current *report, job *docker.Job) {
+	if current.repository.Deployments {
+		id, err := reporter.createDeployment(current, job)
+		if err != nil {
+			forgeLog.With("container", job.Container).With("repository", current.repository.Name).Errorf("Error while creating deployment: %v", err)
+		}
+		current.deploymentId = id
+		reporter.deploymentStatus(current, job, "in_progress")
+	}
+	reporter.commitStatus(current, job, "pending", "Deploying "+job.Container)
+}
+
+//Post the final status of a job
+func (reporter *Reporter) end(current *report, job *docker.Job) {
+	state, deployment := "success", "success"
+	description := fmt.Sprintf("%s %s", job.Container, job.Status)
+	switch job.Status {
+	case docker.UpdateFailed:
+		state, deployment = "failure", "failure"
+		if job.Error != "" {
+			description += ": " + job.Error
+		}
+	case docker.UpdateInterrupted:
+		//The update is resumed after the restart of docker-ci and reported by its new job
+		state, deployment = "pending", "queued"
+	case docker.UpdateIgnored:
+		//Deployments can't be left in progress and commit statuses have no neutral state
+		state, deployment = "success", "inactive"
+	}
+	reporter.commitStatus(current, job, state, description)
+	reporter.deploymentStatus(current, job, deployment)
+}
+
+func (reporter *Reporter) commitStatus(current *report, job *docker.Job, state string, description string) {
+	if len(description) > descriptionMaxLength {
+		description = description[:descriptionMaxLength-3] + "..."
+	}
+	body := map[string]string{
+		"state":       state,
+		"target_url":  jobUrl(job),
+		"description": description,
+		"context":     "docker-ci/" + job.Container,
+	}
+	path := fmt.Sprintf("/repos/%s/statuses/%s", ownerAndName(current.repository), current.sha)
+	if err := call(current, path, body, nil); err != nil {
+		forgeLog.With("container", job.Container).With("repository", current.repository.Name).Errorf("Error while reporting %s status: %v", state, err)
+	}
+}
+
+func (reporter *Reporter) createDeployment(current *report, job *docker.Job) (int64, error) {
+	body := map[string]interface{}{
+		"ref":               current.sha,
+		"environment":       reporter.environment(job),
+		"description":       "Deploy of " + job.Container + " by docker-ci",
+		"auto_merge":        false,
+		"required_contexts": []string{},
+	}
+	var deployment struct {
+		Id int64 `json:"id"`
+	}
+	err := call(current, fmt.Sprintf("/repos/%s/deployments", ownerAndName(current.repository)), body, &deployment)
+	return deployment.Id, err
+}
+
+func (reporter *Reporter) deploymentStatus(current *report, job *docker.Job, state string) {
+	if current.deploymentId == 0 {
+		return
+	}
+	body := map[string]string{
+		"state":       state,
+		"log_url":     jobUrl(job),
+		"environment": reporter.environment(job),
+	}
+	path := fmt.Sprintf("/repos/%s/deployments/%d/statuses", ownerAndName(current.repository), current.deploymentId)
+	if err := call(current, path, body, nil); err != nil {
+		forgeLog.With("container", job.Container).With("repository", current.repository.Name).Errorf("Error while reporting %s deployment: %v", state, err)
+	}
+}
+
+//Get the deployment environment of a job container
+func (reporter *Reporter) environment(job *docker.Job) string {
+	if container, ok := reporter.registry.GetByName(job.Container); ok {
+		if environment := container.Labels[environmentLabel]; environment != "" {
+			return environment
+		}
+	}
+	return job.Container
+}
+
+//Link to the job log in the dashboard
+func jobUrl(job *docker.Job) string {
+	base := os.Getenv("BASE_URL")
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/#job=" + job.Id
+}
+
+func ownerAndName(repository Repository) string {
+	return strings.SplitN(repository.Name, "/", 2)[1]
+}
+
+//Send a POST request to the api of the forge and decode the response in result if it is not nil
+func call(current *report, path string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", current.repository.ApiUrl+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Docker-CI")
+	//The token scheme is accepted by both Github and Gitea
+	req.Header.Set("Authorization", "token "+current.token)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", path, res.StatusCode)
+	}
+	if result != nil {
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+	return nil
+}
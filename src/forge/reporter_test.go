@@ -0,0 +1,163 @@
+package forge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dockerci/src/docker"
+)
+
+const testSha = "0123456789abcdef0123456789abcdef01234567"
+
+//Call received by the test forge
+type forgeCall struct {
+	path          string
+	authorization string
+	body          map[string]interface{}
+}
+
+//Forge answering every call, the deployments get the id 42
+func testForge(t *testing.T, block chan struct{}) (*httptest.Server, chan forgeCall) {
+	calls := make(chan forgeCall, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if block != nil {
+			<-block
+		}
+		call := forgeCall{path: req.URL.Path, authorization: req.Header.Get("Authorization")}
+		if err := json.NewDecoder(req.Body).Decode(&call.body); err != nil {
+			t.Errorf("invalid body on %s: %v", req.URL.Path, err)
+		}
+		calls <- call
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func testReporter(t *testing.T, server *httptest.Server, deployments bool) *Reporter {
+	store, err := Open(filepath.Join(t.TempDir(), "forge.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(Repository{Name: "https://github.com/owner/app.git", ApiUrl: server.URL, Deployments: deployments}, "ghp_test"); err != nil {
+		t.Fatal(err)
+	}
+	return NewReporter(store, docker.NewRegistry(nil))
+}
+
+func jobEvent(eventType string, status string, err string) docker.Event {
+	return docker.Event{Kind: docker.JobEventKind, Type: eventType, Job: &docker.Job{
+		Id: "1a2b", Container: "app", Repository: "https://github.com/owner/app.git", Commit: testSha, Status: status, Error: err,
+	}}
+}
+
+func nextCall(t *testing.T, calls chan forgeCall) forgeCall {
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("no call received by the forge")
+		return forgeCall{}
+	}
+}
+
+func TestReporterPostsStatusesAndDeployments(t *testing.T) {
+	t.Setenv("BASE_URL", "https://ci.example.com/")
+	server, calls := testForge(t, nil)
+	reporter := testReporter(t, server, true)
+	reporter.OnJobEvent(jobEvent(docker.JobStarted, docker.JobRunning, ""))
+	reporter.OnJobEvent(jobEvent(docker.JobEnded, docker.UpdateUpdated, ""))
+	expected := []struct {
+		path   string
+		fields map[string]interface{}
+	}{
+		{"/repos/owner/app/deployments", map[string]interface{}{"ref": testSha, "environment": "app"}},
+		{"/repos/owner/app/deployments/42/statuses", map[string]interface{}{"state": "in_progress", "log_url": "https://ci.example.com/#job=1a2b"}},
+		{"/repos/owner/app/statuses/" + testSha, map[string]interface{}{"state": "pending", "target_url": "https://ci.example.com/#job=1a2b", "context": "docker-ci/app", "description": "Deploying app"}},
+		{"/repos/owner/app/statuses/" + testSha, map[string]interface{}{"state": "success", "target_url": "https://ci.example.com/#job=1a2b", "description": "app updated"}},
+		{"/repos/owner/app/deployments/42/statuses", map[string]interface{}{"state": "success", "environment": "app"}},
+	}
+	for _, want := range expected {
+		call := nextCall(t, calls)
+		if call.path != want.path {
+			t.Fatalf("got call to %s, want %s", call.path, want.path)
+		}
+		if call.authorization != "token ghp_test" {
+			t.Errorf("got authorization %q on %s", call.authorization, call.path)
+		}
+		for field, value := range want.fields {
+			if call.body[field] != value {
+				t.Errorf("got %s %v on %s, want %v", field, call.body[field], call.path, value)
+			}
+		}
+	}
+	if len(reporter.reports) != 0 {
+		t.Errorf("report of the ended job kept")
+	}
+}
+
+func TestReporterFailedJob(t *testing.T) {
+	t.Setenv("BASE_URL", "")
+	server, calls := testForge(t, nil)
+	reporter := testReporter(t, server, false)
+	reporter.OnJobEvent(jobEvent(docker.JobStarted, docker.JobRunning, ""))
+	reporter.OnJobEvent(jobEvent(docker.JobEnded, docker.UpdateFailed, "Error while pulling image"))
+	if call := nextCall(t, calls); call.body["state"] != "pending" {
+		t.Fatalf("got %v, want the pending status first", call.body)
+	}
+	call := nextCall(t, calls)
+	if call.body["state"] != "failure" || call.body["description"] != "app failed: Error while pulling image" {
+		t.Errorf("got %v", call.body)
+	}
+	//Without BASE_URL there is no link to the job
+	if call.body["target_url"] != "" {
+		t.Errorf("got target url %v", call.body["target_url"])
+	}
+}
+
+func TestReporterDoesNotBlockTheBus(t *testing.T) {
+	block := make(chan struct{})
+	server, calls := testForge(t, block)
+	reporter := testReporter(t, server, false)
+	done := make(chan struct{})
+	go func() {
+		reporter.OnJobEvent(jobEvent(docker.JobStarted, docker.JobRunning, ""))
+		reporter.OnJobEvent(jobEvent(docker.JobEnded, docker.UpdateUpdated, ""))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job events blocked by the forge")
+	}
+	close(block)
+	if call := nextCall(t, calls); call.body["state"] != "pending" {
+		t.Errorf("got %v, want pending", call.body)
+	}
+	if call := nextCall(t, calls); call.body["state"] != "success" {
+		t.Errorf("got %v, want success", call.body)
+	}
+}
+
+func TestReporterExpiresUnfinishedReports(t *testing.T) {
+	server, calls := testForge(t, nil)
+	reporter := testReporter(t, server, false)
+	reporter.OnJobEvent(jobEvent(docker.JobStarted, docker.JobRunning, ""))
+	nextCall(t, calls)
+	reporter.reports["1a2b"].createdAt = time.Now().Add(-reportTTL - time.Minute)
+	other := jobEvent(docker.JobStarted, docker.JobRunning, "")
+	other.Job.Id = "3c4d"
+	reporter.OnJobEvent(other)
+	nextCall(t, calls)
+	if _, ok := reporter.reports["1a2b"]; ok {
+		t.Error("unfinished report not expired")
+	}
+	if _, ok := reporter.reports["3c4d"]; !ok {
+		t.Error("running report expired")
+	}
+}
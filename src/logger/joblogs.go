@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultJobLogRetention = 20               //Log files kept for each container
+	defaultJobLogMaxSize   = 10 * 1024 * 1024 //Maximum size of a job log file in bytes
+)
+
+var ErrJobLogNotFound = errors.New("job log not found")
+
+//Names allowed in the job log paths, container names and job ids both match it
+var safeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+//Directory of the job log files : <dir>/<container>/<job id>.log
+//Only the last files of each container are kept and each file is capped in size
+type JobLogs struct {
+	dir       string
+	retention int
+	maxSize   int64
+	mutex     sync.Mutex
+}
+
+//Open the job logs directory with the JOB_LOG_RETENTION and JOB_LOG_MAX_SIZE env vars
+func OpenJobLogs(dir string) *JobLogs {
+	logs := &JobLogs{dir: dir, retention: defaultJobLogRetention, maxSize: defaultJobLogMaxSize}
+	if retention, err := strconv.Atoi(os.Getenv("JOB_LOG_RETENTION")); err == nil && retention > 0 {
+		logs.retention = retention
+	}
+	if maxSize, err := strconv.ParseInt(os.Getenv("JOB_LOG_MAX_SIZE"), 10, 64); err == nil && maxSize > 0 {
+		logs.maxSize = maxSize
+	}
+	return logs
+}
+
+//Create the log file of a job and remove the oldest files of the container
+func (logs *JobLogs) Create(container string, jobId string) (*JobLogFile, error) {
+	if !safeName.MatchString(container) || !safeName.MatchString(jobId) {
+		return nil, errors.New("invalid job log name " + container + "/" + jobId)
+	}
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+	dir := filepath.Join(logs.dir, container)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, jobId+".log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logs.rotate(dir)
+	return &JobLogFile{file: file, remaining: logs.maxSize}, nil
+}
+
+//Remove the oldest log files of a container directory beyond the retention
+func (logs *JobLogs) rotate(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil || len(paths) <= logs.retention {
+		return
+	}
+	modTimes := make(map[string]int64, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime().UnixNano()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]] < modTimes[paths[j]] })
+	for _, path := range paths[:len(paths)-logs.retention] {
+		os.Remove(path)
+	}
+}
+
+//Open the log file of a job, the container is found from the directory layout
+//It returns the container of the job with the file
+func (logs *JobLogs) Open(jobId string) (string, io.ReadCloser, error) {
+	if !safeName.MatchString(jobId) {
+		return "", nil, ErrJobLogNotFound
+	}
+	paths, err := filepath.Glob(filepath.Join(logs.dir, "*", jobId+".log"))
+	if err != nil || len(paths) == 0 {
+		return "", nil, ErrJobLogNotFound
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Base(filepath.Dir(paths[0])), file, nil
+}
+
+//Log file of a running job, the writes beyond the size limit are dropped
+type JobLogFile struct {
+	mutex     sync.Mutex
+	file      *os.File
+	remaining int64
+	truncated bool
+}
+
+func (logFile *JobLogFile) Write(data []byte) (int, error) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	if logFile.file == nil {
+		return 0, os.ErrClosed
+	}
+	if int64(len(data)) > logFile.remaining {
+		if !logFile.truncated {
+			logFile.truncated = true
+			logFile.file.WriteString("[log truncated, size limit reached]\n")
+		}
+		return len(data), nil
+	}
+	logFile.remaining -= int64(len(data))
+	return logFile.file.Write(data)
+}
+
+func (logFile *JobLogFile) Close() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	if logFile.file == nil {
+		return nil
+	}
+	err := logFile.file.Close()
+	logFile.file = nil
+	return err
+}
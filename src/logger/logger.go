@@ -0,0 +1,183 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if int(level) < len(levelNames) {
+		return levelNames[level]
+	}
+	return "unknown"
+}
+
+//Parse a level name (debug, info, warn, error)
+func ParseLevel(name string) (Level, bool) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) || (levelName == "warn" && strings.EqualFold(name, "warning")) {
+			return Level(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+//Destination shared by all the loggers
+var output = struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  Level
+	json   bool
+}{writer: os.Stderr, level: LevelInfo}
+
+//Key value pair attached to the entries of a logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+//Leveled logger with fields, the entries are written as text or JSON lines
+//A logger can also copy its entries to other writers (e.g: the log file of a job) whatever the level
+type Logger struct {
+	fields []field
+	tees   []io.Writer
+}
+
+//Logger without fields, the standard log package is redirected to it by Configure
+var Default = &Logger{}
+
+//Read the LOG_LEVEL, LOG_FORMAT and VERBOSE env vars and redirect the standard log package
+//VERBOSE=true is a shortcut for LOG_LEVEL=debug
+func Configure() {
+	output.mutex.Lock()
+	if level, ok := ParseLevel(os.Getenv("LOG_LEVEL")); ok {
+		output.level = level
+	} else if os.Getenv("LOG_LEVEL") != "" {
+		fmt.Fprintf(output.writer, "Invalid LOG_LEVEL %s, using info\n", os.Getenv("LOG_LEVEL"))
+	}
+	if os.Getenv("VERBOSE") == "true" {
+		output.level = LevelDebug
+	}
+	output.json = strings.EqualFold(os.Getenv("LOG_FORMAT"), "json")
+	output.mutex.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+}
+
+//Get a logger with an additional field
+func (logger *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(logger.fields), len(logger.fields)+1)
+	copy(fields, logger.fields)
+	return &Logger{fields: append(fields, field{key, value}), tees: logger.tees}
+}
+
+//Get a logger that also writes its entries in text to w, whatever their level
+func (logger *Logger) Tee(w io.Writer) *Logger {
+	tees := make([]io.Writer, len(logger.tees), len(logger.tees)+1)
+	copy(tees, logger.tees)
+	return &Logger{fields: logger.fields, tees: append(tees, w)}
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+//Log an error and exit, it is meant for the startup errors
+func (logger *Logger) Fatalf(format string, args ...interface{}) {
+	logger.log(LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+//Check if the entries of a level are written to the output
+func Enabled(level Level) bool {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return level >= output.level
+}
+
+func (logger *Logger) log(level Level, msg string) {
+	now := time.Now()
+	for _, tee := range logger.tees {
+		tee.Write([]byte(logger.text(now, level, msg)))
+	}
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	if level < output.level {
+		return
+	}
+	if output.json {
+		output.writer.Write(logger.json(now, level, msg))
+	} else {
+		io.WriteString(output.writer, logger.text(now, level, msg))
+	}
+}
+
+//Format an entry as a text line : <time> <LEVEL> <message> key=value...
+func (logger *Logger) text(now time.Time, level Level, msg string) string {
+	var line strings.Builder
+	line.WriteString(now.Format("2006/01/02 15:04:05 "))
+	line.WriteString(strings.ToUpper(level.String()))
+	line.WriteString(" ")
+	line.WriteString(strings.TrimRight(msg, "\n"))
+	for _, field := range logger.fields {
+		value := fmt.Sprint(field.value)
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(" " + field.key + "=" + value)
+	}
+	line.WriteString("\n")
+	return line.String()
+}
+
+//Format an entry as a JSON line with the time, level, msg and field keys
+func (logger *Logger) json(now time.Time, level Level, msg string) []byte {
+	entry := make(map[string]interface{}, len(logger.fields)+3)
+	for _, field := range logger.fields {
+		entry[field.key] = field.value
+	}
+	entry["time"], entry["level"], entry["msg"] = now.Format(time.RFC3339Nano), level.String(), strings.TrimRight(msg, "\n")
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"time": now.Format(time.RFC3339Nano), "level": level.String(), "msg": msg})
+	}
+	return append(data, '\n')
+}
+
+//Writer receiving the entries of the standard log package, they are logged at the info level
+//docker-ci logs with the leveled loggers, the standard log package is only used by the libraries
+type stdWriter struct{}
+
+func (stdWriter) Write(data []byte) (int, error) {
+	Default.log(LevelInfo, string(data))
+	return len(data), nil
+}
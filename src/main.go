@@ -1,81 +1,427 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"dockerci/src/api"
+	"dockerci/src/api/middleware"
+	"dockerci/src/audit"
 	"dockerci/src/docker"
+	"dockerci/src/forge"
+	"dockerci/src/logger"
+	"dockerci/src/metrics"
+	"dockerci/src/notify"
+	"dockerci/src/tracing"
+	"dockerci/src/users"
+	"dockerci/src/utils"
 
-	"github.com/docker/docker/api/types/events"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
 var client *docker.DockerClient
-var enabledContainers []docker.ContainerInfo
+var registry *docker.Registry
+var queue *docker.UpdateQueue
+var recoverOnce sync.Once
 
-//Parse the environment variables
+//Parse the environment variables and configure the logger
 //Init docker instance and bind events
 //Start event listening and load current container config
-//Start the http server
+//Start the http server and stop it gracefully on SIGINT or SIGTERM
 func main() {
 	if os.Getenv("DOCKER_HOST") == "" {
 		err := godotenv.Load()
 		if err != nil {
-			log.Fatal("Error loading .env file")
+			logger.Default.Fatalf("Error loading .env file")
 		}
 	}
+	logger.Configure()
+	if err := middleware.CheckSigningKey(); err != nil {
+		logger.Default.Fatalf("%v", err)
+	}
+	if err := middleware.LoadRevoked(utils.DataPath("revoked.json")); err != nil {
+		logger.Default.Fatalf("Error while loading the revoked tokens: %v", err)
+	}
+	tracing.Init()
 	client = docker.New()
-	client.Events[docker.Create_container] = onCreateContainer
-	client.Events[docker.Destroy_container] = onDestroyContainer
+	journal, err := docker.OpenJournal(utils.DataPath("journal.json"))
+	if err != nil {
+		logger.Default.Fatalf("Error while loading the update journal: %v", err)
+	}
+	client.Journal = journal
+	if queue, err = docker.OpenUpdateQueue(utils.DataPath("queue.json")); err != nil {
+		logger.Default.Fatalf("Error while loading the update queue: %v", err)
+	}
+	registry = docker.NewRegistry(client)
+	client.Bus.SubscribeFunc("registry", docker.Lossless, docker.Filter{
+		Kinds: []docker.EventKind{docker.ContainerEventKind},
+		Types: []string{
+			string(docker.Create_container), string(docker.Destroy_container), string(docker.Rename_container),
+			string(docker.Update_container), string(docker.Start_container), string(docker.Die_container),
+			string(docker.Health_status_container),
+		},
+	}, onContainerEvent)
+	client.Bus.SubscribeFunc("connection", docker.Lossless, docker.Filter{Kinds: []docker.EventKind{docker.ConnectionEventKind}}, onConnectionChange)
+	if notifier, err := notify.New(registry); err != nil {
+		logger.Default.Warnf("Notifications disabled: %v", err)
+	} else {
+		client.Bus.SubscribeFunc("notify", 64, docker.Filter{Kinds: []docker.EventKind{docker.JobEventKind}, Types: []string{docker.JobEnded}}, notifier.OnJobEnded)
+	}
+	collector := metrics.New(client)
 	go client.ListenToEvents()
 	loadContainersConfig()
-	api.New(&enabledContainers, onRequest).Serve()
+	go registry.Reconcile(reconcileInterval())
+	userStore, err := users.Open(utils.DataPath("users.json"))
+	if err != nil {
+		logger.Default.Fatalf("Error while loading users: %v", err)
+	}
+	keyStore, err := users.OpenKeys(utils.DataPath("keys.json"))
+	if err != nil {
+		logger.Default.Fatalf("Error while loading api keys: %v", err)
+	}
+	auditLog, err := audit.Open(utils.DataPath("audit.log"))
+	if err != nil {
+		logger.Default.Fatalf("Error while opening audit log: %v", err)
+	}
+	forgeStore, err := forge.Open(utils.DataPath("forge.json"))
+	if err != nil {
+		logger.Default.Fatalf("Error while loading forge repositories: %v", err)
+	}
+	client.Bus.SubscribeFunc("forge", docker.Lossless, docker.Filter{Kinds: []docker.EventKind{docker.JobEventKind}}, forge.NewReporter(forgeStore, registry).OnJobEvent)
+	createDefaultAdmin(userStore)
+	server := api.New(client, registry, userStore, keyStore, auditLog, forgeStore, api.Handlers{
+		OnRequest:        onRequest,
+		OnRepoRequest:    onRepoRequest,
+		OnProjectRequest: onProjectRequest,
+		OnRollback:       onRollback,
+	})
+	collector.WatchHooks(server)
+	server.Handle("/metrics", collector)
+	go server.Serve()
+	waitForShutdown(server)
 }
 
 func loadContainersConfig() {
-	containers := client.GetContainersEnabled()
-	enabledContainers = make([]docker.ContainerInfo, len(containers))
-	for _, container := range containers {
-		name := container.Names[0][1:]
-		enabledContainers = append(enabledContainers, docker.ContainerInfo{Names: container.Names, Id: container.ID})
-		log.Printf("Webhook available at: %s/hooks/%s", os.Getenv("BASE_URL"), name)
+	if err := registry.Load(); err != nil {
+		logger.Default.Errorf("Error while loading containers: %v", err)
+		return
+	}
+	for _, container := range registry.List() {
+		for _, name := range container.HookNames() {
+			if _, conflict := registry.Conflict(name); !conflict {
+				logger.Default.With("container", container.Name()).Infof("Webhook available at: %s/hooks/%s", os.Getenv("BASE_URL"), name)
+			}
+		}
+	}
+	//Docker is reachable, the interrupted updates can be repaired and resumed
+	recoverOnce.Do(func() { go recoverUpdates() })
+}
+
+//Create the admin user from the PASSWORD env var if there is no user yet
+func createDefaultAdmin(userStore *users.Store) {
+	password := os.Getenv("PASSWORD")
+	if !userStore.Empty() || password == "" {
+		return
+	}
+	if err := userStore.Create(users.User{Username: api.DefaultAdmin, Role: users.RoleAdmin}, password); err != nil {
+		logger.Default.Errorf("Error while creating admin user: %v", err)
+		return
+	}
+	logger.Default.With("user", api.DefaultAdmin).Infof("Admin user created")
+}
+
+//Get the registry reconciliation interval from the RECONCILE_INTERVAL env var (1m by default)
+func reconcileInterval() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil && interval > 0 {
+		return interval
 	}
+	return time.Minute
 }
-func onRequest(name string, token string, sock *websocket.Conn) (int, string) {
-	containerInfos := getContainerFromName(name)
-	if containerInfos == nil {
+
+func onRequest(ctx context.Context, name string, token string, push *docker.PushEvent, sock *websocket.Conn) (int, string) {
+	if claimers, conflict := registry.Conflict(name); conflict {
+		return 409, "Hook name claimed by several containers: " + strings.Join(claimers, ", ")
+	}
+	containerInfos, ok := registry.GetByName(name)
+	if !ok {
 		return 400, "Container not found"
 	}
-	log.Println("Request received for service:", name)
-	if err := client.NewRequest(containerInfos.Id, name, token, sock); err != nil {
-		log.Println("Error updating container "+name, err.Error())
-		return 500, "Failed to update container " + name
+	log := logger.Default.With("container", name)
+	if ok, reason := containerInfos.MatchPush(push); !ok {
+		log.Infof("Push ignored: %s", reason)
+		return 204, "ignored: " + reason
 	}
-	log.Printf("Container %s successfully updated", name)
-	return 200, "Done"
+	log.Infof("Request received")
+	request := docker.QueuedUpdate{Trigger: docker.TriggerHook, Target: name, Token: token, Push: push}
+	status, data, calls := queueUpdate(ctx, request, containerInfos.Id, docker.DebounceWindow(containerInfos), func(ctx context.Context) (int, interface{}) {
+		if err := client.NewRequest(ctx, containerInfos.Id, name, token, push, sock); errors.Is(err, docker.ErrShuttingDown) {
+			return 503, err.Error()
+		} else if err != nil {
+			log.Errorf("Error updating container: %v", err)
+			return 500, "Failed to update container " + name
+		}
+		log.Infof("Container successfully updated")
+		return 200, "Done"
+	})
+	if calls > 1 {
+		log.Infof("%d requests coalesced", calls)
+	}
+	return status, data.(string)
 }
-func onCreateContainer(msg events.Message) {
-	if client.IsContainerEnabled(msg.Actor.ID) {
-		log.Println("Container creation detected:", msg.Actor.Attributes["name"])
-		defer loadContainersConfig()
+
+//Recreate a container with the image it was using before its last update
+//The rollback waits for the running update of the container, it is not queued so it is not resumed after restart
+func onRollback(ctx context.Context, name string) (int, string) {
+	containerInfos, ok := registry.GetByName(name)
+	if !ok {
+		return 400, "Container not found"
+	}
+	log := logger.Default.With("container", name)
+	log.Infof("Rollback requested")
+	status, data := client.Updates.Run(containerInfos.Id, func() (int, interface{}) {
+		ctx, span := tracing.Start(tracing.Detach(ctx), "rollback "+name, tracing.KindInternal)
+		defer span.End()
+		if err := client.NewRollback(ctx, containerInfos.Id, name); errors.Is(err, docker.ErrNoRollback) {
+			return 409, "No former image to roll back to for container " + name
+		} else if errors.Is(err, docker.ErrShuttingDown) {
+			return 503, err.Error()
+		} else if err != nil {
+			span.SetStatus(tracing.StatusError, err.Error())
+			log.Errorf("Error rolling back container: %v", err)
+			return 500, "Failed to roll back container " + name
+		}
+		log.Infof("Container successfully rolled back")
+		return 200, "Done"
+	})
+	if data == docker.ErrShuttingDown {
+		data = docker.ErrShuttingDown.Error()
 	}
+	return status, data.(string)
 }
-func onDestroyContainer(msg events.Message) {
-	defer loadContainersConfig()
+
+//Update every enabled container built from the pushed repository
+func onRepoRequest(ctx context.Context, token string, push *docker.PushEvent) (int, interface{}) {
+	if push == nil || push.CloneUrl == "" {
+		return 400, "No repository found in payload"
+	}
+	containers := make([]docker.ContainerInfo, 0)
+	results := make([]docker.UpdateResult, 0)
+	for _, container := range registry.GetByRepository(push.CloneUrl) {
+		if ok, reason := container.MatchPush(push); !ok {
+			results = append(results, docker.UpdateResult{Name: container.Name(), Status: docker.UpdateIgnored, Error: reason})
+		} else {
+			containers = append(containers, container)
+		}
+	}
+	if len(containers) == 0 && len(results) == 0 {
+		return 400, "No container found for repository " + push.CloneUrl
+	} else if len(containers) == 0 {
+		return 204, "ignored: " + results[0].Error
+	}
+	log := logger.Default.With("repository", push.CloneUrl)
+	log.Infof("Request received (%d containers)", len(containers))
+	docker.SortContainers(containers)
+	request := docker.QueuedUpdate{Trigger: docker.TriggerRepo, Token: token, Push: push}
+	status, data, calls := queueUpdate(ctx, request, "repo:"+push.CloneUrl, docker.DebounceWindow(containers...), func(ctx context.Context) (int, interface{}) {
+		return resultsStatus(client.NewRepoRequest(ctx, containers, token, push), results)
+	})
+	if calls > 1 {
+		log.Infof("%d requests coalesced", calls)
+	}
+	return status, data
 }
 
-//Get a ContainerInfo object from a container name
-func getContainerFromName(name string) *docker.ContainerInfo {
-	name = strings.ToLower(name)
-	for _, container := range enabledContainers {
-		for _, containerName := range container.Names {
-			if strings.ToLower(containerName) == "/"+name {
-				return &container
-			}
+//Update every enabled container of a compose project in dependency order
+func onProjectRequest(ctx context.Context, project string, token string, push *docker.PushEvent) (int, interface{}) {
+	containers := make([]docker.ContainerInfo, 0)
+	results := make([]docker.UpdateResult, 0)
+	for _, container := range registry.GetByProject(project) {
+		if ok, reason := container.MatchPush(push); !ok {
+			results = append(results, docker.UpdateResult{Name: container.Name(), Status: docker.UpdateIgnored, Error: reason})
+		} else {
+			containers = append(containers, container)
+		}
+	}
+	if len(containers) == 0 && len(results) == 0 {
+		return 400, "No container found for project " + project
+	} else if len(containers) == 0 {
+		return 204, "ignored: " + results[0].Error
+	}
+	log := logger.Default.With("project", project)
+	log.Infof("Request received (%d containers)", len(containers))
+	request := docker.QueuedUpdate{Trigger: docker.TriggerProject, Target: project, Token: token, Push: push}
+	status, data, calls := queueUpdate(ctx, request, "project:"+project, docker.DebounceWindow(containers...), func(ctx context.Context) (int, interface{}) {
+		updateResults, err := client.NewProjectRequest(ctx, project, containers, token, push)
+		if err != nil {
+			log.Errorf("Error updating project: %v", err)
+			return 500, "Failed to update project " + project + ": " + err.Error()
 		}
+		return resultsStatus(updateResults, results)
+	})
+	if calls > 1 {
+		log.Infof("%d requests coalesced", calls)
+	}
+	return status, data
+}
+
+//Get the status of an update from its results, they are appended to the ignored results
+//The status is 503 if an update was interrupted by the shutdown so that the request is resumed after restart
+func resultsStatus(updateResults []docker.UpdateResult, results []docker.UpdateResult) (int, interface{}) {
+	status := 200
+	for _, result := range updateResults {
+		if result.Status == docker.UpdateInterrupted {
+			status = 503
+		} else if result.Status == docker.UpdateFailed && status != 503 {
+			status = 500
+		}
+		results = append(results, result)
+	}
+	return status, results
+}
+
+//Resync the registry when the docker event stream is reconnected as events may have been missed
+//The containers are also loaded on the first connection if docker was unreachable at startup
+func onConnectionChange(event docker.Event) {
+	state := event.Data.(docker.EventStreamState)
+	if !state.Connected {
+		logger.Default.Warnf("Docker event stream disconnected: %s", state.Error)
+	} else if state.Reconnects > 0 {
+		logger.Default.Infof("Docker event stream reconnected, resyncing containers")
+		loadContainersConfig()
+	} else if !registry.Loaded() {
+		logger.Default.Infof("Docker event stream connected, loading containers")
+		loadContainersConfig()
+	}
+}
+
+//Update the registry from container events
+func onContainerEvent(event docker.Event) {
+	_, known := registry.GetById(event.ContainerId)
+	registry.HandleEvent(event)
+	container, enabled := registry.GetById(event.ContainerId)
+	if enabled && !known {
+		log := logger.Default.With("container", container.Name())
+		log.Infof("Container creation detected")
+		for _, name := range container.HookNames() {
+			log.Infof("Webhook available at: %s/hooks/%s", os.Getenv("BASE_URL"), name)
+		}
+	} else if !enabled && known {
+		logger.Default.With("container", event.Container).Infof("Container removal detected")
+	}
+}
+
+//Queue an update in the debouncer and trace the time it waits and the time it runs
+//The update is detached from the request so that a client disconnection can't interrupt it
+//The request is persisted until the update has run, it is resumed after restart if the update is interrupted by the shutdown
+func queueUpdate(ctx context.Context, request docker.QueuedUpdate, key string, window time.Duration, update func(ctx context.Context) (int, interface{})) (int, interface{}, int) {
+	log := logger.Default.With("key", key)
+	id, err := queue.Add(request)
+	if err != nil {
+		log.Errorf("Error while persisting the update, it won't be resumed after restart: %v", err)
+	}
+	ctx, queueSpan := tracing.Start(tracing.Detach(ctx), "queue "+key, tracing.KindInternal)
+	defer queueSpan.End()
+	status, data, calls := client.Updates.Do(key, window, func() (int, interface{}) {
+		//The calls merged into this update keep waiting in their queue span
+		queueSpan.End()
+		ctx, span := tracing.Start(ctx, "update "+key, tracing.KindInternal)
+		defer span.End()
+		status, data := update(ctx)
+		span.SetAttribute("update.status", status)
+		if status >= 500 {
+			span.SetStatus(tracing.StatusError, "")
+		}
+		return status, data
+	})
+	if data == docker.ErrShuttingDown {
+		data = docker.ErrShuttingDown.Error()
+	}
+	if status != 503 {
+		if err := queue.Remove(id); err != nil {
+			log.Errorf("Error while removing the update from the queue: %v", err)
+		}
+	}
+	return status, data, calls
+}
+
+//Repair the containers left stopped by an interrupted update and resume the queued updates
+//Requests queued several times for the same target are resumed once with the most recent push
+func recoverUpdates() {
+	for _, repair := range client.Recover(context.Background()) {
+		log := logger.Default.With("container", repair.Container).With("step", repair.Step)
+		if repair.Error != "" {
+			log.Errorf("Update interrupted: %s (%s)", repair.Result, repair.Error)
+		} else {
+			log.Warnf("Update interrupted: %s", repair.Result)
+		}
+	}
+	latest := make(map[string]docker.QueuedUpdate)
+	targets := make([]string, 0)
+	for _, request := range queue.List() {
+		target := request.Trigger + ":" + request.Target
+		if request.Trigger == docker.TriggerRepo && request.Push != nil {
+			target += request.Push.CloneUrl
+		}
+		if _, ok := latest[target]; !ok {
+			targets = append(targets, target)
+		}
+		latest[target] = request
+		//The resumed request is queued again under a new id
+		if err := queue.Remove(request.Id); err != nil {
+			logger.Default.Errorf("Error while removing a resumed update from the queue: %v", err)
+		}
+	}
+	for _, target := range targets {
+		request := latest[target]
+		logger.Default.With("target", target).Infof("Resuming the %s update queued at %s", request.Trigger, request.QueuedAt.Format(time.RFC3339))
+		go resumeUpdate(request)
+	}
+}
+
+func resumeUpdate(request docker.QueuedUpdate) {
+	ctx := context.Background()
+	switch request.Trigger {
+	case docker.TriggerHook:
+		onRequest(ctx, request.Target, request.Token, request.Push, nil)
+	case docker.TriggerRepo:
+		onRepoRequest(ctx, request.Token, request.Push)
+	case docker.TriggerProject:
+		onProjectRequest(ctx, request.Target, request.Token, request.Push)
+	}
+}
+
+//Wait for SIGINT or SIGTERM and stop gracefully
+//The hooks are rejected, the queued updates are kept for the next start and the running ones get the grace period to reach a safe point
+func waitForShutdown(server *api.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	grace := shutdownGracePeriod()
+	logger.Default.Infof("Received %v, shutting down with a grace period of %v", sig, grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	server.StopHooks()
+	if err := client.Updates.Drain(ctx); err != nil {
+		logger.Default.Warnf("Grace period over, the running updates will be repaired and resumed on the next start")
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Default.Errorf("Error while stopping the http server: %v", err)
+	}
+	tracing.Flush()
+	logger.Default.Infof("docker-ci stopped")
+}
+
+//Get the shutdown grace period from the SHUTDOWN_GRACE_PERIOD env var (30s by default)
+func shutdownGracePeriod() time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD")); err == nil && grace > 0 {
+		return grace
 	}
-	return nil
+	return 30 * time.Second
 }
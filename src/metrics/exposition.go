@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Upper bounds in seconds of the duration histogram buckets
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+//Cumulative histogram in the Prometheus format
+type histogram struct {
+	counts []uint64 //Observations lower or equal to each bucket bound
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+//Write the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//Write a sample, labels are given as name, value pairs
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+func writeHistogram(w io.Writer, name string, h *histogram, labels ...string) {
+	for i, bound := range durationBuckets {
+		writeSample(w, name+"_bucket", float64(h.counts[i]), append(append([]string{}, labels...), "le", formatValue(bound))...)
+	}
+	writeSample(w, name+"_bucket", float64(h.count), append(append([]string{}, labels...), "le", "+Inf")...)
+	writeSample(w, name+"_sum", h.sum, labels...)
+	writeSample(w, name+"_count", float64(h.count), labels...)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//Get the sorted keys of a map indexed by strings
+func sortedKeys(m interface{}) []string {
+	values := reflect.ValueOf(m).MapKeys()
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		keys = append(keys, value.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
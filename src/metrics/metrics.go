@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/docker"
+	"dockerci/src/logger"
+)
+
+//Hook call counters of the api server
+type HookStats interface {
+	HookRequests() map[int]uint64
+	HookRejections() map[string]uint64
+}
+
+//Collect the docker-ci metrics and expose them in the Prometheus text format
+//Deploy counters and durations are fed by the job events of the bus, the other metrics are read when scraped
+type Collector struct {
+	docker      *docker.DockerClient
+	hooks       HookStats
+	token       string
+	mutex       sync.Mutex
+	deploys     map[string]map[string]uint64 //Container -> outcome -> deploys
+	durations   *histogram                   //Whole job durations
+	phases      map[string]*histogram        //Phase -> durations
+	lastSuccess map[string]time.Time         //Container -> end of the last successful deploy
+	running     map[string]bool              //Ids of the running jobs
+	transfers   docker.Timeline              //Sum of the transfer and build statistics of the ended jobs
+}
+
+//Create a collector subscribed to the job events, the endpoint is protected by METRICS_TOKEN if it is set
+func New(client *docker.DockerClient) *Collector {
+	collector := &Collector{
+		docker:      client,
+		token:       os.Getenv("METRICS_TOKEN"),
+		deploys:     make(map[string]map[string]uint64),
+		durations:   newHistogram(),
+		phases:      make(map[string]*histogram),
+		lastSuccess: make(map[string]time.Time),
+		running:     make(map[string]bool),
+	}
+	client.Bus.SubscribeFunc("metrics", docker.Lossless, docker.Filter{
+		Kinds: []docker.EventKind{docker.JobEventKind},
+		Types: []string{docker.JobStarted, docker.JobPhaseEnded, docker.JobEnded},
+	}, collector.onJobEvent)
+	return collector
+}
+
+//Set the source of the hook call counters
+func (collector *Collector) WatchHooks(hooks HookStats) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.hooks = hooks
+}
+
+func (collector *Collector) onJobEvent(event docker.Event) {
+	job := event.Job
+	if job == nil {
+		return
+	}
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	switch event.Type {
+	case docker.JobStarted:
+		collector.running[job.Id] = true
+	case docker.JobPhaseEnded:
+		if phase, ok := event.Data.(docker.Phase); ok {
+			if collector.phases[phase.Name] == nil {
+				collector.phases[phase.Name] = newHistogram()
+			}
+			collector.phases[phase.Name].observe(phase.EndedAt.Sub(phase.StartedAt).Seconds())
+		}
+	case docker.JobEnded:
+		delete(collector.running, job.Id)
+		if collector.deploys[job.Container] == nil {
+			collector.deploys[job.Container] = make(map[string]uint64)
+		}
+		collector.deploys[job.Container][job.Status]++
+		collector.durations.observe(job.EndedAt.Sub(job.StartedAt).Seconds())
+		if job.Status == docker.UpdateUpdated || job.Status == docker.UpdateRestarted {
+			collector.lastSuccess[job.Container] = job.EndedAt
+		}
+		collector.transfers.BytesPulled += job.Timeline.BytesPulled
+		collector.transfers.LayersDownloaded += job.Timeline.LayersDownloaded
+		collector.transfers.LayersCached += job.Timeline.LayersCached
+		collector.transfers.BuildSteps += job.Timeline.BuildSteps
+	}
+}
+
+//Serve the metrics, a bearer token is required if METRICS_TOKEN is set
+func (collector *Collector) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if collector.token != "" {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(collector.token)) != 1 {
+			res.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	var body bytes.Buffer
+	collector.write(&body)
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.WriteHeader(200)
+	res.Write(body.Bytes())
+}
+
+func (collector *Collector) write(w *bytes.Buffer) {
+	collector.mutex.Lock()
+	writeHeader(w, "dockerci_deploys_total", "counter", "Deploys by container and outcome")
+	for _, container := range sortedKeys(collector.deploys) {
+		for _, outcome := range sortedKeys(collector.deploys[container]) {
+			writeSample(w, "dockerci_deploys_total", float64(collector.deploys[container][outcome]), "container", container, "outcome", outcome)
+		}
+	}
+	writeHeader(w, "dockerci_deploy_duration_seconds", "histogram", "Duration of the deploys")
+	writeHistogram(w, "dockerci_deploy_duration_seconds", collector.durations)
+	writeHeader(w, "dockerci_deploy_phase_duration_seconds", "histogram", "Duration of the deploy phases (pull, build, stop, recreate, start, remove-image, rollback)")
+	for _, phase := range sortedKeys(collector.phases) {
+		writeHistogram(w, "dockerci_deploy_phase_duration_seconds", collector.phases[phase], "phase", phase)
+	}
+	writeHeader(w, "dockerci_last_successful_deploy_age_seconds", "gauge", "Time since the last successful deploy of the container")
+	for _, container := range sortedKeys(collector.lastSuccess) {
+		writeSample(w, "dockerci_last_successful_deploy_age_seconds", time.Since(collector.lastSuccess[container]).Seconds(), "container", container)
+	}
+	writeHeader(w, "dockerci_running_jobs", "gauge", "Jobs currently running")
+	writeSample(w, "dockerci_running_jobs", float64(len(collector.running)))
+	writeHeader(w, "dockerci_pulled_bytes_total", "counter", "Bytes downloaded by the image pulls")
+	writeSample(w, "dockerci_pulled_bytes_total", float64(collector.transfers.BytesPulled))
+	writeHeader(w, "dockerci_pulled_layers_total", "counter", "Layers of the image pulls, downloaded or already present")
+	writeSample(w, "dockerci_pulled_layers_total", float64(collector.transfers.LayersDownloaded), "cached", "false")
+	writeSample(w, "dockerci_pulled_layers_total", float64(collector.transfers.LayersCached), "cached", "true")
+	writeHeader(w, "dockerci_build_steps_total", "counter", "Steps of the image builds")
+	writeSample(w, "dockerci_build_steps_total", float64(collector.transfers.BuildSteps))
+	hooks := collector.hooks
+	collector.mutex.Unlock()
+
+	writeHeader(w, "dockerci_queue_depth", "gauge", "Updates waiting for their debounce window or for the running update of their container")
+	writeSample(w, "dockerci_queue_depth", float64(collector.docker.Updates.Pending()))
+	stream := collector.docker.EventStreamState()
+	writeHeader(w, "dockerci_event_stream_reconnects_total", "counter", "Reconnections of the docker event stream")
+	writeSample(w, "dockerci_event_stream_reconnects_total", float64(stream.Reconnects))
+	writeHeader(w, "dockerci_event_stream_connected", "gauge", "1 if the docker event stream is connected")
+	writeSample(w, "dockerci_event_stream_connected", boolValue(stream.Connected))
+	if hooks != nil {
+		requests := hooks.HookRequests()
+		statuses := make([]int, 0, len(requests))
+		for status := range requests {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		writeHeader(w, "dockerci_hook_requests_total", "counter", "Hook calls by response status code")
+		for _, status := range statuses {
+			writeSample(w, "dockerci_hook_requests_total", float64(requests[status]), "code", strconv.Itoa(status))
+		}
+		rejections := hooks.HookRejections()
+		writeHeader(w, "dockerci_hook_rejections_total", "counter", "Hook calls rejected by the source ip allowlists")
+		for _, target := range sortedKeys(rejections) {
+			writeSample(w, "dockerci_hook_rejections_total", float64(rejections[target]), "target", target)
+		}
+	}
+	if size, err := collector.docker.BuildCacheSize(); err != nil {
+		logger.Default.With("component", "metrics").Errorf("Error while reading build cache usage: %v", err)
+	} else {
+		writeHeader(w, "dockerci_build_cache_bytes", "gauge", "Disk space used by the docker build cache")
+		writeSample(w, "dockerci_build_cache_bytes", float64(size))
+	}
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Maximum length of a Discord message
+const discordMaxLength = 2000
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+//Email sent with the SMTP_* env vars
+type emailChannel struct {
+	to []string
+}
+
+//Slack, Discord or Mattermost incoming webhook
+type chatChannel struct {
+	kind string
+	url  string
+}
+
+//Generic JSON webhook, the body is signed with NOTIFY_WEBHOOK_SECRET
+type webhookChannel struct {
+	url string
+}
+
+//Get the channel of a recipient url (mailto:a@b.c, slack:https://..., discord:https://..., mattermost:https://..., webhook:https://...)
+func ParseChannel(recipient string) (Channel, error) {
+	parts := strings.SplitN(recipient, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("recipient must be <channel>:<target>")
+	}
+	kind, target := strings.ToLower(parts[0]), parts[1]
+	switch kind {
+	case "mailto":
+		return &emailChannel{to: strings.Split(target, ";")}, nil
+	case "slack", "discord", "mattermost":
+		return &chatChannel{kind: kind, url: target}, nil
+	case "webhook":
+		return &webhookChannel{url: target}, nil
+	}
+	return nil, fmt.Errorf("unknown channel %s", kind)
+}
+
+func (channel *emailChannel) Send(msg *Message) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return errors.New("SMTP_HOST is not set")
+	}
+	from := envOr("SMTP_FROM", "docker-ci@"+host)
+	//An address with a line break would add headers or recipients to the email
+	for _, address := range append([]string{from}, channel.to...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return fmt.Errorf("invalid email address %q", address)
+		}
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(channel.to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", headerValue(msg.Subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	//STARTTLS is used when the server supports it
+	return smtp.SendMail(net.JoinHostPort(host, envOr("SMTP_PORT", "25")), auth, from, channel.to, body.Bytes())
+}
+
+//Replace the line breaks of a header value so that the value can't add headers
+func headerValue(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func (channel *chatChannel) Send(msg *Message) error {
+	var payload map[string]string
+	switch channel.kind {
+	case "discord":
+		//Discord counts characters, a multi-byte character must not be split
+		text := []rune(msg.Subject + "\n" + msg.Text)
+		if len(text) > discordMaxLength {
+			text = append(text[:discordMaxLength-3], []rune("...")...)
+		}
+		payload = map[string]string{"content": string(text)}
+	default:
+		payload = map[string]string{"text": "*" + msg.Subject + "*\n" + msg.Text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(channel.url, body, nil)
+}
+
+//The timestamp and the body are signed with HMAC-SHA-256 in the X-Docker-Ci-Signature-256 header (sha256=<hex>)
+//The signed payload is "<timestamp>.<body>" so that a receiver can reject the replayed notifications from their timestamp
+func (channel *webhookChannel) Send(msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	headers := map[string]string{"X-Docker-Ci-Event": "job.ended", "X-Docker-Ci-Timestamp": timestamp}
+	if secret := os.Getenv("NOTIFY_WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		headers["X-Docker-Ci-Signature-256"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return post(channel.url, body, headers)
+}
+
+func post(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Docker-CI")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", redact(url), res.StatusCode)
+	}
+	return nil
+}
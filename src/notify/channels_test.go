@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var testMessage = &Message{JobId: "1a2b", Container: "app", Status: "failed", Subject: "[docker-ci] app failed", Text: "Update of app failed\nError: pull"}
+
+//Receiver recording the requests it gets
+func receiver(t *testing.T) (*httptest.Server, chan *http.Request, chan []byte) {
+	requests, bodies := make(chan *http.Request, 1), make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- req
+		bodies <- body
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, bodies
+}
+
+func TestWebhookSignature(t *testing.T) {
+	t.Setenv("NOTIFY_WEBHOOK_SECRET", "secret")
+	server, requests, bodies := receiver(t)
+	if err := (&webhookChannel{url: server.URL}).Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	req, body := <-requests, <-bodies
+	timestamp := req.Header.Get("X-Docker-Ci-Timestamp")
+	if sentAt, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sentAt, 0)) > time.Minute {
+		t.Errorf("got timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if signature := req.Header.Get("X-Docker-Ci-Signature-256"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("got signature %q", signature)
+	}
+	if event := req.Header.Get("X-Docker-Ci-Event"); event != "job.ended" {
+		t.Errorf("got event %q", event)
+	}
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil || msg.JobId != testMessage.JobId || msg.Text != testMessage.Text {
+		t.Errorf("got payload %s (%v)", body, err)
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	t.Setenv("NOTIFY_WEBHOOK_SECRET", "")
+	server, requests, _ := receiver(t)
+	if err := (&webhookChannel{url: server.URL}).Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if signature := (<-requests).Header.Get("X-Docker-Ci-Signature-256"); signature != "" {
+		t.Errorf("got signature %q without secret", signature)
+	}
+}
+
+func TestChatPayloads(t *testing.T) {
+	long := *testMessage
+	long.Text = strings.Repeat("x", discordMaxLength)
+	accents := *testMessage
+	accents.Text = strings.Repeat("é", discordMaxLength)
+	tests := []struct {
+		kind    string
+		msg     *Message
+		payload map[string]string
+	}{
+		{"slack", testMessage, map[string]string{"text": "*[docker-ci] app failed*\nUpdate of app failed\nError: pull"}},
+		{"mattermost", testMessage, map[string]string{"text": "*[docker-ci] app failed*\nUpdate of app failed\nError: pull"}},
+		{"discord", testMessage, map[string]string{"content": "[docker-ci] app failed\nUpdate of app failed\nError: pull"}},
+		{"discord", &long, map[string]string{"content": ("[docker-ci] app failed\n" + long.Text)[:discordMaxLength-3] + "..."}},
+		{"discord", &accents, map[string]string{"content": string([]rune("[docker-ci] app failed\n" + accents.Text)[:discordMaxLength-3]) + "..."}},
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			server, requests, bodies := receiver(t)
+			channel, err := ParseChannel(test.kind + ":" + server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := channel.Send(test.msg); err != nil {
+				t.Fatal(err)
+			}
+			if contentType := (<-requests).Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("got content type %q", contentType)
+			}
+			var payload map[string]string
+			if err := json.Unmarshal(<-bodies, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if !utf8.ValidString(payload["content"]) || utf8.RuneCountInString(payload["content"]) > discordMaxLength {
+				t.Errorf("got %d characters, valid utf-8: %v", utf8.RuneCountInString(payload["content"]), utf8.ValidString(payload["content"]))
+			}
+			if len(payload) != len(test.payload) || payload["text"] != test.payload["text"] || payload["content"] != test.payload["content"] {
+				t.Errorf("got payload %v, want %v", payload, test.payload)
+			}
+		})
+	}
+}
+
+//Email received by the SMTP sink
+type mail struct {
+	from string
+	to   []string
+	data string
+}
+
+//SMTP server accepting one email without TLS nor authentication
+func smtpSink(t *testing.T) (string, chan mail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	mails := make(chan mail, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		var received mail
+		text.PrintfLine("220 sink")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case command == "EHLO" || command == "HELO":
+				text.PrintfLine("250 sink")
+			case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+				received.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				text.PrintfLine("250 OK")
+			case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+				received.to = append(received.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				text.PrintfLine("250 OK")
+			case command == "DATA":
+				text.PrintfLine("354 Go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received.data = string(data)
+				text.PrintfLine("250 OK")
+				mails <- received
+			case command == "QUIT":
+				text.PrintfLine("221 Bye")
+				return
+			default:
+				text.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func TestEmail(t *testing.T) {
+	addr, mails := smtpSink(t)
+	host, port, _ := net.SplitHostPort(addr)
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_FROM", "ci@example.com")
+	t.Setenv("SMTP_USERNAME", "")
+	channel, err := ParseChannel("mailto:ops@example.com;dev@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := *testMessage
+	msg.Subject = "[docker-ci] app failed\r\nBcc: attacker@example.com"
+	if err := channel.Send(&msg); err != nil {
+		t.Fatal(err)
+	}
+	received := <-mails
+	if received.from != "ci@example.com" || strings.Join(received.to, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("got envelope %s -> %v", received.from, received.to)
+	}
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(received.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Bcc") != "" {
+		t.Error("header injected through the subject")
+	}
+	if subject := header.Get("Subject"); subject != "[docker-ci] app failed Bcc: attacker@example.com" {
+		t.Errorf("got subject %q", subject)
+	}
+	if to := header.Get("To"); to != "ops@example.com, dev@example.com" {
+		t.Errorf("got to %q", to)
+	}
+	if !strings.Contains(received.data, "Update of app failed\nError: pull") {
+		t.Errorf("got body %q", received.data)
+	}
+}
+
+func TestEmailRejectsLineBreaksInAddresses(t *testing.T) {
+	t.Setenv("SMTP_HOST", "127.0.0.1")
+	t.Setenv("SMTP_PORT", "1")
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"recipient", "ci@example.com", "ops@example.com\r\nBcc: attacker@example.com"},
+		{"sender", "ci@example.com\nBcc: attacker@example.com", "ops@example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SMTP_FROM", test.from)
+			err := (&emailChannel{to: []string{test.to}}).Send(testMessage)
+			if err == nil || !strings.Contains(err.Error(), "invalid email address") {
+				t.Errorf("got error %v, want the address rejected", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"dockerci/src/docker"
+	"dockerci/src/logger"
+)
+
+const (
+	notifyLabel   = "docker-ci.notify"
+	notifyOnLabel = "docker-ci.notify-on"
+	sendAttempts  = 3
+)
+
+//Logger of the notification entries
+var notifyLog = logger.Default.With("component", "notify")
+
+const defaultSubject = `[docker-ci] {{.Container}} {{.Status}}`
+const defaultTemplate = `Update of {{.Container}} {{.Status}} after {{.Duration}} ({{.Trigger}})
+Image: {{.Image}}{{if .Commit}}
+Commit: {{.Commit}}{{end}}{{if .Digest}}
+Digest: {{.Digest}}{{end}}{{if .Error}}
+Error: {{.Error}}{{end}}{{if .URL}}
+{{.URL}}{{end}}`
+
+//Content of a job notification, it is also the data given to the templates
+type Message struct {
+	JobId       string        `json:"jobId"`
+	Container   string        `json:"container"`
+	ContainerId string        `json:"containerId"`
+	Trigger     string        `json:"trigger"`
+	Status      string        `json:"status"`
+	Image       string        `json:"image"`
+	Commit      string        `json:"commit,omitempty"`
+	Digest      string        `json:"digest,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	StartedAt   time.Time     `json:"startedAt"`
+	EndedAt     time.Time     `json:"endedAt"`
+	Duration    time.Duration `json:"-"`
+	DurationMs  int64         `json:"durationMs"`
+	URL         string        `json:"url,omitempty"` //Dashboard url
+	Subject     string        `json:"subject"`
+	Text        string        `json:"text"`
+}
+
+//Destination of the notifications
+type Channel interface {
+	Send(msg *Message) error
+}
+
+//Send the job outcomes to the global recipients (NOTIFY env var) and to the container recipients (docker-ci.notify label)
+//Recipients are comma separated urls : mailto:, slack:, discord:, mattermost: or webhook:
+type Notifier struct {
+	registry *docker.Registry
+	global   []string
+	on       []string //Job statuses notified
+	subject  *template.Template
+	text     *template.Template
+}
+
+func New(registry *docker.Registry) (*Notifier, error) {
+	subject, err := template.New("subject").Parse(envOr("NOTIFY_SUBJECT", defaultSubject))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_SUBJECT: %v", err)
+	}
+	text, err := template.New("text").Parse(envOr("NOTIFY_TEMPLATE", defaultTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_TEMPLATE: %v", err)
+	}
+	return &Notifier{
+		registry: registry,
+		global:   splitList(os.Getenv("NOTIFY")),
+		on:       splitList(envOr("NOTIFY_ON", docker.UpdateFailed)),
+		subject:  subject,
+		text:     text,
+	}, nil
+}
+
+//Notify the recipients of a job when it ends
+func (notifier *Notifier) OnJobEnded(event docker.Event) {
+	if event.Job == nil {
+		return
+	}
+	job := event.Job
+	recipients, on := notifier.global, notifier.on
+	container, ok := notifier.registry.GetByName(job.Container)
+	if !ok {
+		container, ok = notifier.registry.GetById(job.ContainerId)
+	}
+	if ok {
+		recipients = append(append([]string{}, recipients...), splitList(container.Labels[notifyLabel])...)
+		if label := splitList(container.Labels[notifyOnLabel]); len(label) > 0 {
+			on = label
+		}
+	}
+	if len(recipients) == 0 || !contains(on, job.Status) {
+		return
+	}
+	msg, err := notifier.message(job)
+	if err != nil {
+		notifyLog.With("job", job.Id).Errorf("Error while rendering notification: %v", err)
+		return
+	}
+	for _, recipient := range recipients {
+		channel, err := ParseChannel(recipient)
+		if err != nil {
+			notifyLog.With("recipient", redact(recipient)).Warnf("Invalid notification recipient: %v", err)
+			continue
+		}
+		go send(channel, recipient, msg)
+	}
+}
+
+//Build the message of a job with the templates
+func (notifier *Notifier) message(job *docker.Job) (*Message, error) {
+	msg := &Message{
+		JobId:       job.Id,
+		Container:   job.Container,
+		ContainerId: job.ContainerId,
+		Trigger:     job.Trigger,
+		Status:      job.Status,
+		Image:       job.Image,
+		Commit:      job.Commit,
+		Digest:      job.Digest,
+		Error:       job.Error,
+		StartedAt:   job.StartedAt,
+		EndedAt:     job.EndedAt,
+		Duration:    job.EndedAt.Sub(job.StartedAt).Round(time.Second),
+		DurationMs:  job.EndedAt.Sub(job.StartedAt).Milliseconds(),
+		URL:         os.Getenv("BASE_URL"),
+	}
+	var subject, text bytes.Buffer
+	if err := notifier.subject.Execute(&subject, msg); err != nil {
+		return nil, err
+	}
+	if err := notifier.text.Execute(&text, msg); err != nil {
+		return nil, err
+	}
+	msg.Subject, msg.Text = subject.String(), text.String()
+	return msg, nil
+}
+
+//Send a message with retries
+func send(channel Channel, recipient string, msg *Message) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := channel.Send(msg)
+		if err == nil {
+			return
+		}
+		if attempt == sendAttempts {
+			notifyLog.With("recipient", redact(recipient)).Errorf("Error while notifying: %v", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+//Hide the path of the recipient urls as chat webhook urls contain their secret
+func redact(recipient string) string {
+	if i := strings.Index(recipient, "://"); i >= 0 {
+		if j := strings.Index(recipient[i+3:], "/"); j >= 0 {
+			return recipient[:i+3+j] + "/..."
+		}
+	}
+	return recipient
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(env string, fallback string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return fallback
+}
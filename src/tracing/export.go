@@ -0,0 +1,266 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/logger"
+)
+
+const (
+	exportQueueSize = 2048            //Spans waiting to be exported, the spans are dropped when it is full
+	exportBatchSize = 512             //Maximum number of spans sent in one request
+	exportInterval  = 5 * time.Second //Maximum time a span waits before being sent
+)
+
+//Destination of the ended spans
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+var provider struct {
+	mutex    sync.RWMutex
+	exporter Exporter
+}
+
+//Set the exporter of the ended spans, tracing is disabled if it is nil
+func SetExporter(exporter Exporter) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.exporter = exporter
+}
+
+//Check if the spans are recorded
+func Enabled() bool {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	return provider.exporter != nil
+}
+
+func export(span *Span) {
+	provider.mutex.RLock()
+	exporter := provider.exporter
+	provider.mutex.RUnlock()
+	if exporter != nil {
+		exporter.ExportSpan(span)
+	}
+}
+
+//Send the spans buffered by the exporter, it is called before exiting
+func Flush() {
+	provider.mutex.RLock()
+	exporter := provider.exporter
+	provider.mutex.RUnlock()
+	if flusher, ok := exporter.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+}
+
+//Enable the OTLP export if OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT is set
+func Init() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "docker-ci"
+	}
+	SetExporter(NewOTLPExporter(endpoint, service, parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))))
+	logger.Default.With("component", "tracing").Infof("Exporting traces to %s", endpoint)
+}
+
+//Keep the ended spans in memory, it is meant for tests
+type InMemoryExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{spans: make([]*Span, 0)}
+}
+
+func (exporter *InMemoryExporter) ExportSpan(span *Span) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = append(exporter.spans, span)
+}
+
+//Get the ended spans in the order they ended
+func (exporter *InMemoryExporter) Spans() []*Span {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	return append([]*Span{}, exporter.spans...)
+}
+
+func (exporter *InMemoryExporter) Reset() {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = exporter.spans[:0]
+}
+
+//Send the spans in batches to an OTLP/HTTP collector with the JSON encoding
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	headers  map[string]string
+	queue    chan *Span
+	flush    chan chan struct{}
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string, service string, headers map[string]string) *OTLPExporter {
+	exporter := &OTLPExporter{
+		endpoint: endpoint,
+		service:  service,
+		headers:  headers,
+		queue:    make(chan *Span, exportQueueSize),
+		flush:    make(chan chan struct{}),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	go exporter.run()
+	return exporter
+}
+
+func (exporter *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case exporter.queue <- span:
+	default:
+		//The export must never slow down the deploys
+	}
+}
+
+//Send the queued spans and wait for the end of the request
+func (exporter *OTLPExporter) Flush() {
+	done := make(chan struct{})
+	exporter.flush <- done
+	<-done
+}
+
+func (exporter *OTLPExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := exporter.send(batch); err != nil {
+			logger.Default.With("component", "tracing").Errorf("Error while exporting traces: %v", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-exporter.queue:
+			if batch = append(batch, span); len(batch) == exportBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-exporter.flush:
+			for len(exporter.queue) > 0 {
+				batch = append(batch, <-exporter.queue)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func (exporter *OTLPExporter) send(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, encodeSpan(span))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": encodeAttributes(map[string]interface{}{"service.name": exporter.service})},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "dockerci"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", exporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range exporter.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+//Encode a span in the OTLP JSON format, the ids are hex encoded
+func encodeSpan(span *Span) map[string]interface{} {
+	encoded := map[string]interface{}{
+		"traceId":           span.Context.TraceIdHex(),
+		"spanId":            span.Context.SpanIdHex(),
+		"name":              span.Name,
+		"kind":              span.Kind,
+		"startTimeUnixNano": strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		"attributes":        encodeAttributes(span.attributes()),
+		"status":            map[string]interface{}{"code": span.Status, "message": span.StatusMessage},
+	}
+	if span.Parent != [8]byte{} {
+		encoded["parentSpanId"] = SpanContext{SpanId: span.Parent}.SpanIdHex()
+	}
+	return encoded
+}
+
+func encodeAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var any map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			any = map[string]interface{}{"boolValue": value}
+		case int:
+			any = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			any = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			any = map[string]interface{}{"doubleValue": value}
+		default:
+			any = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": any})
+	}
+	return encoded
+}
+
+//Parse the OTEL_EXPORTER_OTLP_HEADERS format : key1=value1,key2=value2
+func parseHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" {
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return headers
+}
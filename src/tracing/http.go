@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"dockerci/src/utils"
+)
+
+const traceparentHeader = "traceparent"
+
+//Docker api version prefix removed from the span names
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+//Parse a W3C traceparent header : 00-<trace id>-<parent span id>-<flags>
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceId[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanId[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.IsValid()
+}
+
+//Get the traceparent header of a span
+func (span *Span) Traceparent() string {
+	if span == nil {
+		return ""
+	}
+	return "00-" + span.Context.TraceIdHex() + "-" + span.Context.SpanIdHex() + "-01"
+}
+
+//Get a context carrying the remote parent of a traceparent header
+func Extract(ctx context.Context, header http.Header) context.Context {
+	if sc, ok := ParseTraceparent(header.Get(traceparentHeader)); ok {
+		return context.WithValue(ctx, remoteKey{}, sc)
+	}
+	return ctx
+}
+
+//Trace the requests with a server span, the parent is read from the traceparent header
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !Enabled() {
+			next.ServeHTTP(res, req)
+			return
+		}
+		ctx, span := Start(Extract(req.Context(), req.Header), req.Method+" "+req.URL.Path, KindServer)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+		writer := &utils.StatusWriter{ResponseWriter: res}
+		defer func() {
+			span.SetAttribute("http.status_code", writer.Status())
+			if writer.Status() >= 500 {
+				span.SetStatus(StatusError, "")
+			}
+			span.End()
+		}()
+		next.ServeHTTP(writer, req.WithContext(ctx))
+	})
+}
+
+//Round tripper creating a client span for each docker api call made with a traced context
+//Requests without span in their context (e.g: the docker event stream) are not traced
+type transport struct {
+	next http.RoundTripper
+}
+
+func DockerTransport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if SpanFromContext(req.Context()) == nil {
+		return t.next.RoundTrip(req)
+	}
+	_, span := Start(req.Context(), "docker "+req.Method+" "+apiVersionPrefix.ReplaceAllString(req.URL.Path, "/"), KindClient)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, span.Traceparent())
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return res, err
+	}
+	span.SetAttribute("http.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		span.SetStatus(StatusError, "")
+	}
+	//Streamed responses (pull, build) are traced until their body is closed
+	res.Body = &tracedBody{ReadCloser: res.Body, span: span}
+	return res, nil
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	span *Span
+}
+
+func (body *tracedBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.span.End()
+	return err
+}
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+//Kind of a span, the values are the OTLP ones
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+//Status code of a span, the values are the OTLP ones
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOk    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+//Identifiers of a span propagated to its children and in the traceparent header
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId != [16]byte{} && sc.SpanId != [8]byte{}
+}
+
+func (sc SpanContext) TraceIdHex() string {
+	return hex.EncodeToString(sc.TraceId[:])
+}
+
+func (sc SpanContext) SpanIdHex() string {
+	return hex.EncodeToString(sc.SpanId[:])
+}
+
+//Timed operation of a trace, a nil span is valid and records nothing
+type Span struct {
+	mutex         sync.Mutex
+	Name          string
+	Kind          SpanKind
+	Context       SpanContext
+	Parent        [8]byte //Zero for the root spans
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{}
+	Status        StatusCode
+	StatusMessage string
+	ended         bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+//Start a span as a child of the span of the context, or of the remote parent extracted from a traceparent header
+//The context is returned unchanged with a nil span when tracing is disabled
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), Attributes: make(map[string]interface{})}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.Context.TraceId, span.Parent = parent.Context.TraceId, parent.Context.SpanId
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.IsValid() {
+		span.Context.TraceId, span.Parent = remote.TraceId, remote.SpanId
+	} else {
+		crand.Read(span.Context.TraceId[:])
+	}
+	crand.Read(span.Context.SpanId[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+//Get the span of a context, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+//Get a background context carrying the span of ctx
+//It is used for the work that must outlive the request that started it
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if span := SpanFromContext(ctx); span != nil {
+		detached = context.WithValue(detached, spanKey{}, span)
+	}
+	if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		detached = context.WithValue(detached, remoteKey{}, remote)
+	}
+	return detached
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.Attributes[key] = value
+}
+
+func (span *Span) SetStatus(code StatusCode, message string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.Status, span.StatusMessage = code, message
+}
+
+//Mark the span as failed if err is not nil
+func (span *Span) SetError(err error) {
+	if err != nil {
+		span.SetStatus(StatusError, err.Error())
+	}
+}
+
+//End the span and send it to the exporter, the calls after the first one are ignored
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended, span.EndTime = true, time.Now()
+	span.mutex.Unlock()
+	export(span)
+}
+
+//Get a copy of the span attributes
+func (span *Span) attributes() map[string]interface{} {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	attributes := make(map[string]interface{}, len(span.Attributes))
+	for key, value := range span.Attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
@@ -0,0 +1,190 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanId  = "00f067aa0ba902b7"
+)
+
+func inMemory(t *testing.T) *InMemoryExporter {
+	exporter := NewInMemoryExporter()
+	SetExporter(exporter)
+	t.Cleanup(func() { SetExporter(nil) })
+	return exporter
+}
+
+//Get an ended span by name
+func spanNamed(t *testing.T, exporter *InMemoryExporter, name string) *Span {
+	for _, span := range exporter.Spans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("span %s not exported", name)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"valid", "00-" + testTraceId + "-" + testSpanId + "-01", true},
+		{"not sampled", "00-" + testTraceId + "-" + testSpanId + "-00", true},
+		{"future version with more fields", "01-" + testTraceId + "-" + testSpanId + "-01-extra", true},
+		{"surrounding spaces", " 00-" + testTraceId + "-" + testSpanId + "-01 ", true},
+		{"empty", "", false},
+		{"invalid version", "ff-" + testTraceId + "-" + testSpanId + "-01", false},
+		{"missing flags", "00-" + testTraceId + "-" + testSpanId, false},
+		{"short trace id", "00-" + testTraceId[:30] + "-" + testSpanId + "-01", false},
+		{"short span id", "00-" + testTraceId + "-" + testSpanId[:14] + "-01", false},
+		{"not hex", "00-" + testTraceId[:31] + "z-" + testSpanId + "-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + testSpanId + "-01", false},
+		{"zero span id", "00-" + testTraceId + "-0000000000000000-01", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(test.header)
+			if ok != test.valid {
+				t.Fatalf("got valid %v, want %v", ok, test.valid)
+			}
+			if ok && (sc.TraceIdHex() != testTraceId || sc.SpanIdHex() != testSpanId) {
+				t.Errorf("got %s-%s", sc.TraceIdHex(), sc.SpanIdHex())
+			}
+		})
+	}
+}
+
+func TestMiddlewareExtractsTraceparent(t *testing.T) {
+	exporter := inMemory(t)
+	tests := []struct {
+		name        string
+		traceparent string
+		status      int
+		remote      bool
+	}{
+		{"remote parent", "00-" + testTraceId + "-" + testSpanId + "-01", http.StatusOK, true},
+		{"invalid traceparent", "00-" + testTraceId + "-zz-01", http.StatusOK, false},
+		{"no traceparent", "", http.StatusInternalServerError, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter.Reset()
+			req := httptest.NewRequest("POST", "/hooks/app", nil)
+			if test.traceparent != "" {
+				req.Header.Set("traceparent", test.traceparent)
+			}
+			Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if SpanFromContext(r.Context()) == nil {
+					t.Error("no span in the request context")
+				}
+				w.WriteHeader(test.status)
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			span := spanNamed(t, exporter, "POST /hooks/app")
+			remote := span.Context.TraceIdHex() == testTraceId && SpanContext{SpanId: span.Parent}.SpanIdHex() == testSpanId
+			if remote != test.remote {
+				t.Errorf("got trace %s with parent %x, remote parent: %v", span.Context.TraceIdHex(), span.Parent, test.remote)
+			}
+			if !test.remote && span.Parent != [8]byte{} {
+				t.Errorf("root span has parent %x", span.Parent)
+			}
+			if span.Kind != KindServer || span.Attributes["http.status_code"] != test.status {
+				t.Errorf("got kind %d and status %v", span.Kind, span.Attributes["http.status_code"])
+			}
+			if (span.Status == StatusError) != (test.status >= 500) {
+				t.Errorf("got span status %d for http status %d", span.Status, test.status)
+			}
+		})
+	}
+}
+
+//Follow a hook through the spans started by the api, the update queue, the job and the docker client
+func TestSpanParenting(t *testing.T) {
+	exporter := inMemory(t)
+	received := make(chan string, 1)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("traceparent")
+		w.Write([]byte("{}"))
+	}))
+	defer daemon.Close()
+	client := &http.Client{Transport: DockerTransport(http.DefaultTransport)}
+
+	req := httptest.NewRequest("POST", "/hooks/app", nil)
+	req.Header.Set("traceparent", "00-"+testTraceId+"-"+testSpanId+"-01")
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//The update is detached from the request like the queued updates
+		ctx, queue := Start(Detach(r.Context()), "queue app", KindInternal)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			queue.End()
+			ctx, update := Start(ctx, "update app", KindInternal)
+			defer update.End()
+			ctx, job := Start(ctx, "job app", KindInternal)
+			defer job.End()
+			call, err := http.NewRequestWithContext(ctx, "GET", daemon.URL+"/v1.41/containers/app/json", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res, err := client.Do(call)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+		<-done
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	chain := []string{"POST /hooks/app", "queue app", "update app", "job app", "docker GET /containers/app/json"}
+	var parent SpanContext
+	hex.Decode(parent.SpanId[:], []byte(testSpanId))
+	for _, name := range chain {
+		span := spanNamed(t, exporter, name)
+		if span.Context.TraceIdHex() != testTraceId {
+			t.Errorf("span %s is in trace %s", name, span.Context.TraceIdHex())
+		}
+		if span.Parent != parent.SpanId {
+			t.Errorf("span %s has parent %x, want %x", name, span.Parent, parent.SpanId)
+		}
+		parent = span.Context
+	}
+	docker := spanNamed(t, exporter, "docker GET /containers/app/json")
+	if traceparent := <-received; traceparent != docker.Traceparent() {
+		t.Errorf("daemon got traceparent %q, want %q", traceparent, docker.Traceparent())
+	}
+	if docker.Kind != KindClient || docker.Attributes["http.status_code"] != http.StatusOK {
+		t.Errorf("got kind %d and status %v", docker.Kind, docker.Attributes["http.status_code"])
+	}
+}
+
+func TestUntracedDockerCalls(t *testing.T) {
+	exporter := inMemory(t)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if traceparent := req.Header.Get("traceparent"); traceparent != "" {
+			t.Errorf("got traceparent %q without span", traceparent)
+		}
+	}))
+	defer daemon.Close()
+	call, err := http.NewRequestWithContext(context.Background(), "GET", daemon.URL+"/v1.41/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: DockerTransport(http.DefaultTransport)}).Do(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("got %d spans for a call without span", len(spans))
+	}
+}
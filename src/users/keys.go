@@ -0,0 +1,283 @@
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dockerci/src/docker"
+	"dockerci/src/logger"
+	"dockerci/src/utils"
+)
+
+//Prefix of the api key tokens, used to tell them apart from access tokens
+const KeyPrefix = "dci_"
+
+//Minimum time between two writes of the last used timestamp of a key
+const keyUsageFlush = time.Minute
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+//Long-lived api key used by automations, it acts on behalf of its owner
+type Key struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Grants     []Grant    `json:"grants"`
+	Actions    []Action   `json:"actions"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+//Key as it is persisted, only the hash of the secret is stored
+type keyRecord struct {
+	Key
+	SecretHash string `json:"secretHash"`
+	flushedAt  time.Time
+}
+
+//Api key of an authenticated request, it can't do more than its owner
+type KeyPrincipal struct {
+	Key   Key
+	Owner User
+}
+
+//Api key store persisted in a json file
+type KeyStore struct {
+	path    string
+	mutex   sync.RWMutex
+	keys    map[string]*keyRecord
+	version uint64     //Incremented on each snapshot of the keys, guarded by mutex
+	file    sync.Mutex //Held while the file is written, the usage of the keys is written without holding mutex
+	written uint64     //Version of the keys in the file, guarded by file
+}
+
+//Open the api key store from a json file, the file is created on the first save
+func OpenKeys(path string) (*KeyStore, error) {
+	store := &KeyStore{path: path, keys: make(map[string]*keyRecord)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := make([]*keyRecord, 0)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		store.keys[record.Id] = record
+	}
+	return store, nil
+}
+
+//Check if a bearer token is an api key
+func IsKeyToken(token string) bool {
+	return strings.HasPrefix(token, KeyPrefix)
+}
+
+//Check if an action is valid
+func (action Action) Valid() bool {
+	return action == ActionRead || action == ActionTrigger || action == ActionRollback
+}
+
+//Check if the key is expired
+func (key *Key) Expired() bool {
+	return key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)
+}
+
+//Check if the key can do an action on a container
+func (key *Key) Can(action Action, container *docker.ContainerInfo) bool {
+	if key.Expired() || !containsAction(key.Actions, action) {
+		return false
+	}
+	for _, grant := range key.Grants {
+		if grant.Match(container) {
+			return true
+		}
+	}
+	return false
+}
+
+//The key must allow the action and its owner must still be allowed to do it
+func (principal *KeyPrincipal) Can(action Action, container *docker.ContainerInfo) bool {
+	return principal.Key.Can(action, container) && principal.Owner.Can(action, container)
+}
+
+//Create a key and get its token, the token can't be retrieved afterwards
+func (store *KeyStore) Create(key Key) (Key, string, error) {
+	if key.Name == "" || key.Owner == "" || len(key.Actions) == 0 || len(key.Grants) == 0 {
+		return Key{}, "", errors.New("name, actions and grants are required")
+	}
+	for _, action := range key.Actions {
+		if !action.Valid() {
+			return Key{}, "", errors.New("invalid action " + string(action))
+		}
+	}
+	if key.Expired() {
+		return Key{}, "", errors.New("expiration is in the past")
+	}
+	key.Id = utils.RandomHex(8)
+	key.CreatedAt = time.Now()
+	key.LastUsedAt = nil
+	secret := utils.RandomHex(32)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.keys[key.Id] = &keyRecord{Key: key, SecretHash: hashSecret(secret)}
+	if err := store.save(); err != nil {
+		delete(store.keys, key.Id)
+		return Key{}, "", err
+	}
+	return key, KeyPrefix + key.Id + "_" + secret, nil
+}
+
+//Get the key of a token if it is valid and not expired and record its usage
+func (store *KeyStore) Authenticate(token string) (Key, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(token, KeyPrefix), "_", 2)
+	if !IsKeyToken(token) || len(parts) != 2 {
+		return Key{}, false
+	}
+	store.mutex.Lock()
+	record, ok := store.keys[parts[0]]
+	//The secret hash is compared even if the key doesn't exist so that key ids can't be detected from the response time
+	hash := strings.Repeat("0", sha256.Size*2)
+	if ok {
+		hash = record.SecretHash
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(parts[1]))) != 1 || !ok || record.Expired() {
+		store.mutex.Unlock()
+		return Key{}, false
+	}
+	now := time.Now()
+	record.LastUsedAt = &now
+	key := record.Key
+	//The usage is only persisted from time to time to avoid a write on each request
+	if now.Sub(record.flushedAt) <= keyUsageFlush {
+		store.mutex.Unlock()
+		return key, true
+	}
+	record.flushedAt = now
+	data, version, err := store.snapshot()
+	store.mutex.Unlock()
+	//The requests authenticated meanwhile don't wait for the disk
+	if err == nil {
+		err = store.write(data, version)
+	}
+	if err != nil {
+		logger.Default.With("key", key.Id).Errorf("Error while saving the usage of the api key: %v", err)
+	}
+	return key, true
+}
+
+//Get a key from its id
+func (store *KeyStore) Get(id string) (Key, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if record, ok := store.keys[id]; ok {
+		return record.Key, true
+	}
+	return Key{}, false
+}
+
+//Get the keys of an owner sorted by creation date, all the keys are returned if the owner is empty
+func (store *KeyStore) List(owner string) []Key {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keys := make([]Key, 0)
+	for _, record := range store.keys {
+		if owner == "" || record.Owner == owner {
+			keys = append(keys, record.Key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+//Revoke a key
+func (store *KeyStore) Revoke(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(store.keys, id)
+	return store.save()
+}
+
+//Revoke all the keys of an owner
+func (store *KeyStore) RevokeOwner(owner string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	revoked := false
+	for id, record := range store.keys {
+		if record.Owner == owner {
+			delete(store.keys, id)
+			revoked = true
+		}
+	}
+	if !revoked {
+		return nil
+	}
+	return store.save()
+}
+
+//Write the store to its file, the write lock must be held
+func (store *KeyStore) save() error {
+	data, version, err := store.snapshot()
+	if err != nil {
+		return err
+	}
+	return store.write(data, version)
+}
+
+//Serialize the keys with a new version, the write lock must be held
+func (store *KeyStore) snapshot() ([]byte, uint64, error) {
+	records := make([]*keyRecord, 0, len(store.keys))
+	for _, record := range store.keys {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	store.version++
+	return data, store.version, nil
+}
+
+//Write a snapshot to the file unless a more recent one has already been written
+func (store *KeyStore) write(data []byte, version uint64) error {
+	store.file.Lock()
+	defer store.file.Unlock()
+	if version <= store.written {
+		return nil
+	}
+	if err := utils.WriteFileAtomic(store.path, data, 0600); err != nil {
+		return err
+	}
+	store.written = version
+	return nil
+}
+
+//The secrets are random so a fast hash is enough
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func containsAction(actions []Action, action Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
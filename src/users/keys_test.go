@@ -0,0 +1,84 @@
+package users
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newKey(t *testing.T, store *KeyStore) (Key, string) {
+	key, token, err := store.Create(Key{Name: "ci", Owner: "admin", Actions: []Action{ActionTrigger}, Grants: []Grant{{Container: "*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, token
+}
+
+func TestAuthenticatePersistsUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := OpenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, token := newKey(t, store)
+	if _, ok := store.Authenticate(token); !ok {
+		t.Fatal("valid token refused")
+	}
+	if _, ok := store.Authenticate(token + "x"); ok {
+		t.Fatal("wrong secret accepted")
+	}
+	reopened, err := OpenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, ok := reopened.Get(key.Id); !ok || saved.LastUsedAt == nil {
+		t.Errorf("usage not persisted: %+v", saved)
+	}
+}
+
+func TestAuthenticateDoesNotRestoreRevokedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := OpenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token := newKey(t, store)
+	revoked, _ := newKey(t, store)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Authenticate(token)
+		}()
+	}
+	if err := store.Revoke(revoked.Id); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	reopened, err := OpenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(revoked.Id); ok {
+		t.Error("revoked key written back by an older snapshot")
+	}
+}
+
+func TestAuthenticateWhenTheFileCantBeWritten(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenKeys(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token := newKey(t, store)
+	//The store file is now under a regular file
+	if err := ioutil.WriteFile(filepath.Join(dir, "blocker"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store.path = filepath.Join(dir, "blocker", "keys.json")
+	if _, ok := store.Authenticate(token); !ok {
+		t.Error("token refused because its usage can't be saved")
+	}
+}
@@ -0,0 +1,288 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"dockerci/src/docker"
+	"dockerci/src/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role string
+type Action string
+
+const (
+	RoleAdmin    Role = "admin"    //Every action on every container and user management
+	RoleDeployer Role = "deployer" //Read, trigger and rollback the granted containers
+	RoleViewer   Role = "viewer"   //Read the granted containers
+)
+
+const (
+	ActionRead     Action = "read"
+	ActionTrigger  Action = "trigger"
+	ActionRollback Action = "rollback"
+)
+
+var ErrNotFound = errors.New("user not found")
+var ErrExists = errors.New("user already exists")
+var ErrLocalUser = errors.New("a local user already has this username")
+
+//Hash compared when a user doesn't exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("docker-ci"), bcrypt.DefaultCost)
+
+//Container scope of a user, every non empty field must match
+type Grant struct {
+	Container string `json:"container,omitempty"` //Glob on the container name or hook name
+	Project   string `json:"project,omitempty"`   //Compose project name
+	Selector  string `json:"selector,omitempty"`  //Label selector (key=value or key)
+}
+
+//Identity acting on containers, a user or an api key
+type Principal interface {
+	Can(action Action, container *docker.ContainerInfo) bool
+}
+
+type User struct {
+	Username string  `json:"username"`
+	Role     Role    `json:"role"`
+	Grants   []Grant `json:"grants"`
+	Provider string  `json:"provider,omitempty"` //External identity provider, empty for local users
+}
+
+//User as it is persisted
+type record struct {
+	User
+	PasswordHash string `json:"passwordHash"`
+}
+
+//User store persisted in a json file
+type Store struct {
+	path  string
+	mutex sync.RWMutex
+	users map[string]*record
+}
+
+//Open the user store from a json file, the file is created on the first save
+func Open(path string) (*Store, error) {
+	store := &Store{path: path, users: make(map[string]*record)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := make([]*record, 0)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		store.users[record.Username] = record
+	}
+	return store, nil
+}
+
+//Check if a role is valid
+func (role Role) Valid() bool {
+	return role == RoleAdmin || role == RoleDeployer || role == RoleViewer
+}
+
+//Check if the user can do an action on a container
+//Admins can do everything, other users are limited to their role and their grants
+func (user *User) Can(action Action, container *docker.ContainerInfo) bool {
+	switch user.Role {
+	case RoleAdmin:
+		return true
+	case RoleDeployer:
+		if action != ActionRead && action != ActionTrigger && action != ActionRollback {
+			return false
+		}
+	case RoleViewer:
+		if action != ActionRead {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, grant := range user.Grants {
+		if grant.Match(container) {
+			return true
+		}
+	}
+	return false
+}
+
+//Check if the grant scope contains the container
+func (grant *Grant) Match(container *docker.ContainerInfo) bool {
+	if grant.Container == "" && grant.Project == "" && grant.Selector == "" {
+		return false
+	}
+	if grant.Container != "" && !matchGlob(grant.Container, container.Name()) && !matchGlob(grant.Container, container.Hook) {
+		return false
+	}
+	if grant.Project != "" && !matchGlob(grant.Project, container.Project()) {
+		return false
+	}
+	if grant.Selector != "" {
+		selector := strings.SplitN(grant.Selector, "=", 2)
+		label, ok := container.Labels[strings.TrimSpace(selector[0])]
+		if !ok || (len(selector) == 2 && label != strings.TrimSpace(selector[1])) {
+			return false
+		}
+	}
+	return true
+}
+
+//Check the password of a user
+func (store *Store) Authenticate(username string, password string) (User, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, ok := store.users[username]
+	if !ok {
+		//A hash is still compared so that unknown users can't be detected from the response time
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)) != nil {
+		return User{}, false
+	}
+	return record.User, true
+}
+
+//Get a user from its username
+func (store *Store) Get(username string) (User, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if record, ok := store.users[username]; ok {
+		return record.User, true
+	}
+	return User{}, false
+}
+
+//Get all the users sorted by username
+func (store *Store) List() []User {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	users := make([]User, 0, len(store.users))
+	for _, record := range store.users {
+		users = append(users, record.User)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+//Check if there is no user in the store
+func (store *Store) Empty() bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return len(store.users) == 0
+}
+
+//Create a user with a hashed password
+func (store *Store) Create(user User, password string) error {
+	if user.Username == "" || password == "" || !user.Role.Valid() {
+		return errors.New("username, password and a valid role are required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.users[user.Username]; ok {
+		return ErrExists
+	}
+	if user.Grants == nil {
+		user.Grants = make([]Grant, 0)
+	}
+	user.Provider = ""
+	store.users[user.Username] = &record{User: user, PasswordHash: string(hash)}
+	return store.save()
+}
+
+//Create or update a user authenticated by an external provider, the role is updated and the grants are kept
+//Provisioned users have no password, local users can't be taken over by a provider
+func (store *Store) Provision(username string, role Role, provider string) (User, error) {
+	if username == "" || !role.Valid() || provider == "" {
+		return User{}, errors.New("username, provider and a valid role are required")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user, ok := store.users[username]
+	if ok && user.Provider != provider {
+		return User{}, ErrLocalUser
+	}
+	if !ok {
+		user = &record{User: User{Username: username, Grants: make([]Grant, 0), Provider: provider}}
+		store.users[username] = user
+	} else if user.Role == role {
+		return user.User, nil
+	}
+	user.Role = role
+	return user.User, store.save()
+}
+
+//Update the role and the grants of a user, the password is only updated if it is not empty
+func (store *Store) Update(user User, password string) error {
+	if !user.Role.Valid() {
+		return errors.New("invalid role")
+	}
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return err
+		}
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	record, ok := store.users[user.Username]
+	if !ok {
+		return ErrNotFound
+	}
+	if user.Grants == nil {
+		user.Grants = make([]Grant, 0)
+	}
+	user.Provider = record.Provider
+	record.User = user
+	if hash != nil {
+		record.PasswordHash = string(hash)
+	}
+	return store.save()
+}
+
+//Delete a user
+func (store *Store) Delete(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(store.users, username)
+	return store.save()
+}
+
+//Write the store to its file, the write lock must be held
+func (store *Store) save() error {
+	records := make([]*record, 0, len(store.users))
+	for _, record := range store.users {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(store.path, data, 0600)
+}
+
+func matchGlob(pattern string, value string) bool {
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
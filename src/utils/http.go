@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+//Response writer keeping the status code, it can still be hijacked by the websocket hooks
+type StatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (writer *StatusWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *StatusWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *StatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	//Upgraded connections are counted as switching protocols
+	writer.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+//Get the status code sent, 200 if the handler wrote nothing
+func (writer *StatusWriter) Status() int {
+	if writer.status == 0 {
+		return http.StatusOK
+	}
+	return writer.status
+}
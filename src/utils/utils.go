@@ -1,9 +1,14 @@
 package utils
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 )
 
 func InterfaceToStringSlice(params []interface{}) []string {
@@ -41,3 +46,34 @@ func ToJSON(data interface{}) []byte {
 func FromJSON(body io.ReadCloser, obj interface{}) error {
 	return json.NewDecoder(body).Decode(&obj)
 }
+
+//Generate a random hex string from n random bytes
+func RandomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return RandStringRunes(n * 2)
+	}
+	return hex.EncodeToString(b)
+}
+
+//Get the path of a file in the data directory (DATA_DIR env var, ./data by default)
+func DataPath(name string) string {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	return filepath.Join(dir, name)
+}
+
+//Write a file of the data directory, its directory is created if needed
+//The file is replaced atomically so that a crash can't leave it truncated
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
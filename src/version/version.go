@@ -0,0 +1,8 @@
+package version
+
+//Build information, set at build time with :
+//go build -ldflags "-X dockerci/src/version.Version=<version> -X dockerci/src/version.Commit=<sha>"
+var (
+	Version = "dev"
+	Commit  = ""
+)